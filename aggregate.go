@@ -0,0 +1,92 @@
+package gcplog
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorAggregator collapses the error reports sharing the same key within a
+// window, so that an error storm doesn't flood Error Reporting.
+type errorAggregator struct {
+	window time.Duration
+	key    func(err error) string
+
+	mu      sync.Mutex
+	pending map[string]*aggregatedError
+	closed  bool
+}
+
+type aggregatedError struct {
+	err     error
+	request *http.Request
+	stack   []byte
+	repeats int
+	report  func(err error, request *http.Request, stack []byte)
+	timer   *time.Timer
+}
+
+func newErrorAggregator(window time.Duration, key func(err error) string) *errorAggregator {
+	if key == nil {
+		key = func(err error) string { return err.Error() }
+	}
+	return &errorAggregator{
+		window:  window,
+		key:     key,
+		pending: map[string]*aggregatedError{},
+	}
+}
+
+// admit reports whether err is the first of its key in the current window
+// and should be reported right away. Repeats are counted instead, and
+// reported once through report when the window closes.
+func (a *errorAggregator) admit(err error, request *http.Request, stack []byte, report func(err error, request *http.Request, stack []byte)) bool {
+	key := a.key(err)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return true
+	}
+	if aggregated, ok := a.pending[key]; ok {
+		aggregated.repeats++
+		return false
+	}
+	aggregated := &aggregatedError{err: err, request: request, stack: stack, report: report}
+	aggregated.timer = time.AfterFunc(a.window, func() {
+		a.mu.Lock()
+		aggregated, ok := a.pending[key]
+		delete(a.pending, key)
+		a.mu.Unlock()
+
+		if ok {
+			a.reportRepeats(aggregated)
+		}
+	})
+	a.pending[key] = aggregated
+	return true
+}
+
+// close stops the windows still open and reports their repeats right away.
+// The errors admitted afterwards are all reported.
+func (a *errorAggregator) close() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = map[string]*aggregatedError{}
+	a.closed = true
+	a.mu.Unlock()
+
+	for _, aggregated := range pending {
+		aggregated.timer.Stop()
+		a.reportRepeats(aggregated)
+	}
+}
+
+func (a *errorAggregator) reportRepeats(aggregated *aggregatedError) {
+	if aggregated.repeats > 0 {
+		err := fmt.Errorf("%w (repeated %d times in %v)", aggregated.err, aggregated.repeats, a.window)
+		aggregated.report(err, aggregated.request, aggregated.stack)
+	}
+}
@@ -0,0 +1,37 @@
+package gcplog_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestCloseReportsAggregatedRepeats(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:     server.ClientOptions(),
+		ErrorReportWindow: time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		g.ErrorSync(errors.New("storm"))
+	}
+	g.Close()
+
+	errs := server.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("got %d error reports after Close, want the first and the repeats: %+v", len(errs), errs)
+	}
+	if !strings.Contains(errs[1].Message, "repeated 2 times") {
+		t.Errorf("got report %q, want the count of the repeats", errs[1].Message)
+	}
+}
@@ -0,0 +1,75 @@
+package gcplog
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultTextContentTypes are the response content types whose body is
+// captured when GcpLogOptions.TextContentTypes is not set.
+var defaultTextContentTypes = []string{"application/json", "text/*"}
+
+// bodyCapture buffers the textual response bodies used to build the error of
+// failed requests. Binary bodies (images, protobuf...) are only counted, and
+// replaced by a placeholder.
+type bodyCapture struct {
+	isText  func(contentType string) bool
+	body    *bytes.Buffer
+	decided bool
+	text    bool
+	skipped int
+}
+
+func newBodyCapture(g *GcpLog) *bodyCapture {
+	return &bodyCapture{isText: g.isTextContent, body: &bytes.Buffer{}}
+}
+
+// write captures b, written to a response with the given header. The content
+// type is decided on the first write, sniffing b if the header has none.
+func (c *bodyCapture) write(header http.Header, b []byte) {
+	if !c.decided {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(b)
+		}
+		c.text = c.isText(contentType)
+		c.decided = true
+	}
+	if c.text {
+		c.body.Write(b)
+	} else {
+		c.skipped += len(b)
+	}
+}
+
+// buffer returns the captured body, or a placeholder for binary bodies.
+func (c *bodyCapture) buffer() *bytes.Buffer {
+	if c.skipped > 0 {
+		return bytes.NewBufferString(fmt.Sprintf("<binary %d bytes>", c.skipped))
+	}
+	return c.body
+}
+
+func (g *GcpLog) isTextContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	allowed := g.options().TextContentTypes
+	if allowed == nil {
+		allowed = defaultTextContentTypes
+	}
+	for _, t := range allowed {
+		if strings.HasSuffix(t, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
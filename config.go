@@ -0,0 +1,37 @@
+package gcplog
+
+import "sync/atomic"
+
+// config holds the options of a GcpLog and of the loggers derived from it,
+// swapped atomically by Reconfigure.
+type config struct {
+	v atomic.Value
+}
+
+func newConfig(options *GcpLogOptions) *config {
+	c := &config{}
+	c.v.Store(options)
+	return c
+}
+
+func (c *config) load() *GcpLogOptions {
+	return c.v.Load().(*GcpLogOptions)
+}
+
+// options returns the current options of g.
+func (g *GcpLog) options() *GcpLogOptions {
+	return g.config.load()
+}
+
+// Reconfigure swaps the options of g, and of the loggers derived from it,
+// for the subsequent entries, e.g. on a config reload, without recreating the
+// clients. The options used when creating the clients and the background
+// goroutines (ClientOptions, LogID, FlushInterval, ErrorQueueSize,
+// ErrorReportWindow and ErrorReportKey) keep their initial values, as do the
+// buffer limits of the logs already written to.
+func (g *GcpLog) Reconfigure(options GcpLogOptions) {
+	if g == nil {
+		return
+	}
+	g.config.v.Store(&options)
+}
@@ -0,0 +1,113 @@
+package gcplog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	traceHeaderKey
+	batchKey
+	requestKey
+	operationKey
+	timestampKey
+	reportedKey
+	errorKey
+)
+
+// withRequest stashes r in its own context, for the ctx-aware methods to
+// correlate the entries logged inside the handler with the request.
+func withRequest(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestKey, r))
+}
+
+// requestFromContext returns the request stashed by the middlewares, bound
+// to ctx, or nil.
+func requestFromContext(ctx context.Context) *http.Request {
+	if ctx == nil {
+		return nil
+	}
+	r, ok := ctx.Value(requestKey).(*http.Request)
+	if !ok {
+		return nil
+	}
+	return r.WithContext(ctx)
+}
+
+// detachedContext carries the values of its parent but is never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// outboundContext hides from the entry of an outbound call the state of the
+// inbound request whose context it carries: its operation, reported flag and
+// recorded error belong to the inbound entries only. The entry stays in the
+// batch of the inbound request, flushed when it ends.
+type outboundContext struct {
+	context.Context
+}
+
+func (c outboundContext) Value(key interface{}) interface{} {
+	switch key {
+	case operationKey, reportedKey, errorKey:
+		return nil
+	}
+	return c.Context.Value(key)
+}
+
+// withReportedFlag stashes in the context of r a flag set when an error is
+// reported for r, see GcpLogOptions.SuppressDuplicateReports.
+func withReportedFlag(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), reportedKey, new(int32)))
+}
+
+// markReported sets the reported flag of request, if any.
+func markReported(request *http.Request) {
+	if request == nil {
+		return
+	}
+	if flag, ok := request.Context().Value(reportedKey).(*int32); ok {
+		atomic.StoreInt32(flag, 1)
+	}
+}
+
+// isReported reports whether an error was reported for request.
+func isReported(request *http.Request) bool {
+	flag, ok := request.Context().Value(reportedKey).(*int32)
+	return ok && atomic.LoadInt32(flag) == 1
+}
+
+// withContext returns the logger for an entry logged with ctx.
+func (g *GcpLog) withContext(ctx context.Context) *GcpLog {
+	if ctx == nil {
+		return g
+	}
+	logger := g
+	if t, ok := ctx.Value(timestampKey).(time.Time); ok {
+		logger = logger.Timestamped(t)
+	}
+	if labels := contextLabels(ctx); labels != nil {
+		logger = logger.WithLabels(labels)
+	}
+	if g.options().SpanContext != nil {
+		if traceID, spanID, sampled := g.options().SpanContext(ctx); traceID != "" {
+			traced := *logger
+			traced.trace = fmt.Sprintf("projects/%s/traces/%s", g.projectId, traceID)
+			traced.span = spanID
+			traced.traceSampled = sampled
+			logger = &traced
+		}
+	}
+	return logger
+}
@@ -0,0 +1,160 @@
+package gcplog
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// CountingLogger counts hot-path events instead of logging each of them:
+// every interval it writes one Info entry per key with the number of events
+// counted, see GcpLog.CountingLogger.
+type CountingLogger struct {
+	gcplog   *GcpLog
+	interval time.Duration
+	key      func(payload interface{}) string
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	counts map[string]*countedPayload
+}
+
+type countedPayload struct {
+	payload interface{}
+	count   int
+}
+
+// defaultCountingInterval is the interval of a CountingLogger created with
+// none.
+const defaultCountingInterval = time.Minute
+
+// CountingLogger returns a logger aggregating the payloads counted with
+// Count by key, e.g. the event name, over interval (a minute if not
+// positive). A nil key counts all the payloads together. The entry of a key
+// carries its first payload of the interval and the count. The counts
+// pending are written by Stop, or when g is closed.
+func (g *GcpLog) CountingLogger(interval time.Duration, key func(payload interface{}) string) *CountingLogger {
+	if interval <= 0 {
+		interval = defaultCountingInterval
+	}
+	if key == nil {
+		key = func(interface{}) string { return "" }
+	}
+	c := &CountingLogger{
+		gcplog:   g,
+		interval: interval,
+		key:      key,
+		stop:     make(chan struct{}),
+		counts:   map[string]*countedPayload{},
+	}
+	if g != nil {
+		g.closer.addCountingLogger(c)
+		go c.flushEvery()
+	}
+	return c
+}
+
+// Count counts payload under its key.
+func (c *CountingLogger) Count(payload interface{}) {
+	if c == nil || c.gcplog == nil {
+		return
+	}
+	key := c.key(payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if counted, ok := c.counts[key]; ok {
+		counted.count++
+		return
+	}
+	c.counts[key] = &countedPayload{payload: payload, count: 1}
+}
+
+// Flush writes the entries of the counts pending.
+func (c *CountingLogger) Flush() {
+	if c == nil || c.gcplog == nil {
+		return
+	}
+	for _, entry := range c.take() {
+		go c.gcplog.log(entry, nil, nil, logging.Info)
+	}
+}
+
+// Stop stops the periodic writes and writes the counts pending. Counts
+// counted afterwards are only written by Flush. It is idempotent.
+func (c *CountingLogger) Stop() {
+	if c == nil || c.gcplog == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.gcplog.closer.removeCountingLogger(c)
+		// Written synchronously, so that Close flushes them.
+		for _, entry := range c.take() {
+			c.gcplog.log(entry, nil, nil, logging.Info)
+		}
+	})
+}
+
+// take returns the entries of the counts pending, resetting them.
+func (c *CountingLogger) take() []map[string]interface{} {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = map[string]*countedPayload{}
+	c.mu.Unlock()
+
+	entries := make([]map[string]interface{}, 0, len(counts))
+	for key, counted := range counts {
+		entries = append(entries, map[string]interface{}{
+			"key":      key,
+			"count":    counted.count,
+			"interval": c.interval.String(),
+			"payload":  c.gcplog.toPayload(counted.payload),
+		})
+	}
+	return entries
+}
+
+func (c *CountingLogger) flushEvery() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.stop:
+			return
+		case <-c.gcplog.stop:
+			return
+		}
+	}
+}
+
+func (c *closer) addCountingLogger(counting *CountingLogger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counting == nil {
+		c.counting = map[*CountingLogger]struct{}{}
+	}
+	c.counting[counting] = struct{}{}
+}
+
+func (c *closer) removeCountingLogger(counting *CountingLogger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counting, counting)
+}
+
+// countingLoggers returns the CountingLoggers not stopped yet.
+func (c *closer) countingLoggers() []*CountingLogger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loggers := make([]*CountingLogger, 0, len(c.counting))
+	for counting := range c.counting {
+		loggers = append(loggers, counting)
+	}
+	return loggers
+}
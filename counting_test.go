@@ -0,0 +1,44 @@
+package gcplog_test
+
+import (
+	"testing"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestCountingLoggerDefaults(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+
+	// Neither a zero interval nor a nil key panics.
+	counting := g.CountingLogger(0, nil)
+	counting.Count("a")
+	counting.Count("b")
+	g.Close()
+
+	// The counts pending are written on Close.
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool {
+		payload, ok := e.Payload.(map[string]interface{})
+		return ok && payload["count"] == float64(2) && payload["interval"] == "1m0s"
+	})
+}
+
+func TestCountingLoggerStop(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+	defer g.Close()
+
+	counting := g.CountingLogger(0, func(payload interface{}) string { return payload.(string) })
+	counting.Count("event")
+	counting.Stop()
+	counting.Stop()
+	g.FlushLogs()
+
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool {
+		payload, ok := e.Payload.(map[string]interface{})
+		return ok && payload["key"] == "event" && payload["count"] == float64(1)
+	})
+}
@@ -0,0 +1,63 @@
+package gcplog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StackTracer is implemented by errors carrying the stack trace where they
+// were created. The deepest one of a chain of wrapped errors is reported to
+// Error Reporting instead of the stack of the logging call.
+type StackTracer interface {
+	Stack() []byte
+}
+
+// errorChain returns err followed by the errors it wraps, outermost first.
+func errorChain(err error) []error {
+	var chain []error
+	for err != nil {
+		chain = append(chain, err)
+		err = errors.Unwrap(err)
+	}
+	return chain
+}
+
+func chainMessages(chain []error) []string {
+	messages := make([]string, len(chain))
+	for i, err := range chain {
+		messages[i] = err.Error()
+	}
+	return messages
+}
+
+// deepestStack returns the stack of the deepest StackTracer of the chain of
+// err, or nil.
+func deepestStack(err error) []byte {
+	var stack []byte
+	for _, e := range errorChain(err) {
+		if tracer, ok := e.(StackTracer); ok {
+			stack = tracer.Stack()
+		}
+	}
+	return stack
+}
+
+// withRootCause adds the root cause of err to the reported message, unless
+// the message already contains it, so that Error Reporting shows it.
+func withRootCause(err error) error {
+	chain := errorChain(err)
+	root := chain[len(chain)-1]
+	if len(chain) == 1 || strings.Contains(err.Error(), root.Error()) {
+		return err
+	}
+	return fmt.Errorf("%w (root cause: %v)", err, root)
+}
+
+// IgnoreCommonErrors is an IgnoreErrorFunc for errors that are expected in
+// servers, such as cancelled requests and clients disconnecting.
+func IgnoreCommonErrors(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
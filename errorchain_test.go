@@ -0,0 +1,114 @@
+package gcplog_test
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+// chainError is a wrapping error whose message doesn't repeat the one of the
+// error it wraps, with an optional stack.
+type chainError struct {
+	msg   string
+	stack string
+	err   error
+}
+
+func (e *chainError) Error() string { return e.msg }
+func (e *chainError) Unwrap() error { return e.err }
+
+type stackChainError struct{ chainError }
+
+func (e *stackChainError) Stack() []byte { return []byte(e.stack) }
+
+func TestWrappedErrorChain(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+	defer g.Close()
+
+	root := &stackChainError{chainError{
+		msg:   "connection reset",
+		stack: "goroutine 7 [running]:\nmain.dial()\n\t/app/db.go:10 +0x1\n",
+	}}
+	middle := &stackChainError{chainError{
+		msg:   "query failed",
+		stack: "goroutine 7 [running]:\nmain.query()\n\t/app/db.go:20 +0x1\n",
+		err:   root,
+	}}
+	err := &chainError{msg: "request failed", err: middle}
+
+	g.Error(err)
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	want := map[string]interface{}{
+		"message": "request failed",
+		"chain":   []interface{}{"request failed", "query failed", "connection reset"},
+	}
+	if !reflect.DeepEqual(entries[0].Payload, want) {
+		t.Errorf("payload = %#v, want %#v", entries[0].Payload, want)
+	}
+
+	reports := server.WaitForErrors(t, 1, 5*time.Second)
+	message := reports[0].Message
+	if !strings.HasPrefix(message, "request failed (root cause: connection reset)\n") {
+		t.Errorf("report %q doesn't name the root cause", message)
+	}
+	if !strings.Contains(message, "main.dial()") || strings.Contains(message, "main.query()") {
+		t.Errorf("report %q doesn't carry the deepest stack", message)
+	}
+}
+
+type codedError struct{ code string }
+
+func (e *codedError) Error() string { return "coded" }
+func (e *codedError) Code() string  { return e.code }
+
+type payloadError struct{ payload map[string]interface{} }
+
+func (e *payloadError) Error() string                   { return "invalid" }
+func (e *payloadError) Payload() map[string]interface{} { return e.payload }
+
+func TestErrorPayloadType(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+	defer g.Close()
+
+	g.Error(fmt.Errorf("wrapped: %w", &codedError{code: "E42"}))
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	payload, _ := entries[0].Payload.(map[string]interface{})
+	detail, _ := payload["error"].(map[string]interface{})
+	if detail["type"] != "*gcplog_test.codedError" || detail["code"] != "E42" {
+		t.Errorf("error = %v, want the type and code of the ErrorCoder", detail)
+	}
+}
+
+func TestErrorPayloadDoesNotModifyPayload(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+	defer g.Close()
+
+	shared := map[string]interface{}{"field": "name"}
+	g.Error(&payloadError{payload: shared})
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	want := map[string]interface{}{"field": "name", "message": "invalid"}
+	if !reflect.DeepEqual(entries[0].Payload, want) {
+		t.Errorf("payload = %v, want %v", entries[0].Payload, want)
+	}
+	if _, ok := shared["message"]; ok {
+		t.Errorf("the map of Payload was modified: %v", shared)
+	}
+}
@@ -0,0 +1,20 @@
+package fx_test
+
+import (
+	"github.com/ftognetto/gcplog"
+	gcplogfx "github.com/ftognetto/gcplog/fx"
+	"go.uber.org/fx"
+)
+
+func Example() {
+	fx.New(
+		fx.Supply(gcplogfx.Config{
+			ProjectID:   "my-project",
+			ServiceName: "my-service",
+		}),
+		gcplogfx.Module,
+		fx.Invoke(func(g *gcplog.GcpLog) {
+			g.Log("started")
+		}),
+	).Run()
+}
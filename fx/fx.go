@@ -0,0 +1,56 @@
+// Package fx provides the gcplog logger to uber-go/fx applications, kept
+// in a module of its own so that gcplog doesn't depend on fx.
+//
+// Module provides a *gcplog.GcpLog built from the supplied Config, flushed
+// and closed when the application stops.
+package fx
+
+import (
+	"context"
+
+	"github.com/ftognetto/gcplog"
+	"go.uber.org/fx"
+)
+
+// Config is the configuration of the provided logger. An empty ProjectID is
+// resolved as by gcplog.NewGcpLogAuto.
+type Config struct {
+	ProjectID   string
+	ServiceName string
+	Options     gcplog.GcpLogOptions
+}
+
+// Module provides a *gcplog.GcpLog, see New.
+var Module = fx.Options(fx.Provide(New))
+
+// New builds the logger of config, flushing and closing it on the OnStop hook
+// of lc, within the deadline fx gives to the stop hooks. Transient failures
+// are retried as by gcplog.TryNewGcpLog.
+func New(lc fx.Lifecycle, config Config) (*gcplog.GcpLog, error) {
+	logger, err := gcplog.TryNewGcpLog(context.Background(), config.ProjectID, config.ServiceName, config.Options)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			if err := logger.Flush(ctx); err != nil {
+				go logger.Close()
+				return err
+			}
+			// Close still drains what was logged meanwhile, bounded by
+			// ctx rather than by the DrainTimeout of the options.
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				logger.Close()
+			}()
+			select {
+			case <-closed:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	})
+	return logger, nil
+}
@@ -0,0 +1,39 @@
+package fx_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	gcplogfx "github.com/ftognetto/gcplog/fx"
+	"github.com/ftognetto/gcplog/gcplogtest"
+	"go.uber.org/fx"
+)
+
+func TestStopWithinDeadline(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+
+	app := fx.New(
+		fx.NopLogger,
+		fx.Supply(gcplogfx.Config{
+			ProjectID:   "project",
+			ServiceName: "service",
+			Options:     gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()},
+		}),
+		gcplogfx.Module,
+		fx.Invoke(func(g *gcplog.GcpLog) {
+			g.LogSync("started")
+		}),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := app.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool { return e.Payload == "started" })
+}
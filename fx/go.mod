@@ -0,0 +1,12 @@
+module github.com/ftognetto/gcplog/fx
+
+go 1.16
+
+require (
+	github.com/ftognetto/gcplog v1.0.0
+	go.uber.org/fx v1.16.0
+)
+
+// Local development against the root module in this repository; ignored by
+// consumers, who get the required release.
+replace github.com/ftognetto/gcplog => ../
@@ -2,16 +2,25 @@ package gcplog
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
+	"google.golang.org/api/option"
 )
 
 /*
@@ -20,13 +29,252 @@ import (
 
 type GcpLogOptions struct {
 	ExtractUserFromRequest func(r *http.Request) string
-	DevelopmentLogger *log.Logger
+	// ExtractUserFromContext reads the user from the request context, for
+	// identities resolved by an auth layer during the handler chain. It takes
+	// precedence over ExtractUserFromRequest, which is only consulted when it
+	// is not set or returns an empty string.
+	ExtractUserFromContext func(ctx context.Context) string
+	DevelopmentLogger      *log.Logger
+	// LogHeaders is an allowlist of request headers copied into the entry
+	// labels (as "header.<name>"). Names are matched case-insensitively and
+	// headers not in the list are never logged.
+	LogHeaders []string
+	// ResponseLabelHeaders copies the named response headers, e.g. X-Cache,
+	// into the labels of the entries of completed requests (as
+	// "response_header.<name>").
+	ResponseLabelHeaders []string
+	// ClientIPHeaders are the request headers holding the client IP, in the
+	// order they are consulted, e.g. CF-Connecting-IP behind Cloudflare.
+	// Defaults to X-Real-Ip then X-Forwarded-For. The remote address is used
+	// when none is set.
+	ClientIPHeaders []string
+	// FlushInterval, when set, flushes the loggers periodically from a
+	// background goroutine, as FlushLogs does. Useful on platforms (Cloud
+	// Run, Functions) where the process is frozen between requests and
+	// buffered entries would be delayed otherwise.
+	FlushInterval time.Duration
+	// DrainTimeout bounds how long Close waits for buffered entries, and
+	// for the reports queued per ErrorQueueSize, to be delivered. Zero waits
+	// indefinitely.
+	DrainTimeout time.Duration
+	// RedactQueryParams lists query parameters whose values are replaced
+	// before the URL is logged, in addition to common sensitive ones such as
+	// "token" and "password". Names are matched case-insensitively.
+	RedactQueryParams []string
+	// SeverityFunc maps a request handled by the middlewares and its response
+	// status to the severity of the entry. Defaults to Info below 400,
+	// Warning for 4xx and Error for 5xx.
+	SeverityFunc func(r *http.Request, status int) Severity
+	// GenerateRequestID makes the middlewares generate an id for requests
+	// without a X-Request-ID header. The id is stored in the request context
+	// (see RequestID), set on the response header, and logged in the entry
+	// and as the "request_id" label.
+	GenerateRequestID bool
+	// SlowRequestThreshold, when set, raises the severity of requests slower
+	// than it to at least Warning and adds a "slow" label, regardless of the
+	// status code.
+	SlowRequestThreshold time.Duration
+	// Clock is used by the middlewares and Transport to measure the request
+	// latency. Defaults to time.Now.
+	Clock func() time.Time
+	// OnError is called when entries or error reports fail to be delivered,
+	// e.g. to count dropped logs. Defaults to log.Printf.
+	OnError func(err error)
+	// ErrorReportWindow, when set, collapses the errors sharing the same key
+	// within the window into a single report carrying the occurrence count.
+	// Every occurrence is still written to Cloud Logging. The repeats of the
+	// windows still open are reported on Close.
+	ErrorReportWindow time.Duration
+	// ErrorReportKey groups errors for ErrorReportWindow. Defaults to the
+	// error message.
+	ErrorReportKey func(err error) string
+	// ClientOptions are passed to both the logging and error reporting
+	// clients, e.g. to set credentials or to point them at the fake server
+	// of the gcplogtest package.
+	ClientOptions []option.ClientOption
+	// SanitizeURL rewrites the request URL before it is logged or reported,
+	// e.g. to mask sensitive path segments. It receives the URL with the
+	// query parameters already redacted. Defaults to no sanitization.
+	SanitizeURL func(u *url.URL) string
+	// TraceLabelKey is the label holding the trace id of entries with a
+	// trace, for dashboards and tools that don't honor the native trace
+	// field. Defaults to "trace_id".
+	TraceLabelKey string
+	// RequestSequence makes the middlewares number the requests they handle
+	// with a monotonic per-process sequence, set as the "sequence" label, to
+	// order interleaved logs when there are no trace headers.
+	RequestSequence bool
+	// Repanic makes the functions returned by Recover panic again after the
+	// panic has been reported, instead of swallowing it.
+	Repanic bool
+	// DisableRequestBatching makes every entry logged with a request handled
+	// by the middlewares flush on its own. By default they are batched and
+	// flushed once, when the middleware logs the completed request.
+	DisableRequestBatching bool
+	// TextContentTypes lists the response content types whose body is
+	// captured by the middlewares to build the error of failed requests; a
+	// trailing "/*" matches any subtype. Other bodies are replaced by a
+	// "<binary N bytes>" placeholder. Defaults to application/json and text/*.
+	TextContentTypes []string
+	// AfterLog is called after each entry is queued, from the goroutine
+	// writing it, e.g. to count the entries by severity in a metric.
+	AfterLog func(severity Severity, hadRequest bool)
+	// ErrorQueueSize, when set, bounds the error reports waiting to be sent
+	// to Error Reporting. Reports beyond it are dropped and counted (see
+	// DroppedErrorReports), and OnError is called for each of them.
+	ErrorQueueSize int
+	// StructuredRequestLog makes the middlewares log completed requests as a
+	// structured payload (method, path, status, latency_ms, user, request_id,
+	// user_agent), so they can be queried with e.g. jsonPayload.status=500
+	// without parsing the message. The log line, or the error of failed
+	// requests, is merged in under the "message" key. Entries written with
+	// the Log, Warn and Error methods are not affected.
+	StructuredRequestLog bool
+	// TrustForwardedHeaders makes the logged request URL use the scheme and
+	// host from the X-Forwarded-Proto and X-Forwarded-Host headers, i.e. the
+	// ones the client used in front of a load balancer. Only enable it when
+	// the service is reachable through a proxy setting these headers, since
+	// clients could forge them otherwise.
+	TrustForwardedHeaders bool
+	// LogID is the log the entries are written to. Defaults to the service
+	// name. See the *LogID constants for the ones of common runtimes.
+	LogID string
+	// RequestLogID, when set, is the log the middlewares write the entries
+	// of completed requests to, e.g. CloudRunRequestsLogID.
+	RequestLogID string
+	// IgnoreErrorFunc reports whether an error is expected and must not be
+	// reported to Error Reporting. It is still logged at its severity. See
+	// IgnoreCommonErrors.
+	IgnoreErrorFunc func(err error) bool
+	// MinSeverity drops the entries below it. Defaults to logging everything.
+	MinSeverity Severity
+	// DebugRequest selects requests whose entries are all logged regardless
+	// of MinSeverity, e.g. DebugHeader("X-Debug"), to capture more detail for
+	// specific requests without redeploying.
+	DebugRequest func(r *http.Request) bool
+	// EncodePayload normalizes the payloads before the entries are built,
+	// e.g. converting types with unexported fields to maps. When unset,
+	// payloads that cannot be encoded to JSON are logged as "%+v" text.
+	EncodePayload func(payload interface{}) interface{}
+	// MaxPayloadSize is the size in bytes of the encoded payloads above which
+	// they are truncated, as Cloud Logging rejects oversized entries.
+	// Truncated entries are labelled "truncated" and "original_size".
+	// Defaults to DefaultMaxPayloadSize; a negative size disables the guard.
+	MaxPayloadSize int
+	// SeverityLogID routes the entries to a log by severity, e.g. Warning
+	// and up to "errors" and the rest to "access". The entries for which it
+	// returns an empty string stay in their log.
+	SeverityLogID func(severity Severity) string
+	// SpanContext reads the trace id, span id and sampling decision of the
+	// span active in the context of the ctx-aware methods, which take
+	// precedence over the trace header of the request, see otel.SpanContext.
+	// An empty trace id means there is no span.
+	SpanContext func(ctx context.Context) (traceID, spanID string, sampled bool)
+	// SuppressDuplicateReports skips the error report of a failed request
+	// by the middlewares when the handler already reported an error for it,
+	// with the request or its context. The entry is still logged.
+	SuppressDuplicateReports bool
+	// LatencyBuckets are the ascending boundaries of the "latency_bucket"
+	// label of the entries of completed requests, e.g. 10ms, 50ms and 200ms
+	// give "<10ms", "10ms-50ms", "50ms-200ms" and ">=200ms", for latency
+	// dashboards from log-based metrics.
+	LatencyBuckets []time.Duration
+	// BufferDelayThreshold, BufferEntryCountThreshold and
+	// BufferEntryByteThreshold bound how long, how many and how many bytes
+	// of entries are buffered before they are sent, trading memory for
+	// latency. BufferedByteLimit bounds the memory of the buffered entries:
+	// the entries over it are dropped, with logging.ErrOverflow passed to
+	// OnError, rather than blocking the caller. Zero values keep the
+	// defaults of the logging client.
+	BufferDelayThreshold      time.Duration
+	BufferEntryCountThreshold int
+	BufferEntryByteThreshold  int
+	BufferedByteLimit         int
+	// NonErrorStatuses are response statuses that are never errors, e.g. 499
+	// or a deliberate 503 during maintenance: their entries are logged at
+	// Warning at most, and they are not reported to Error Reporting.
+	NonErrorStatuses []int
+	// CaptureRequestBody captures the first RequestBodyLimit bytes
+	// (DefaultRequestBodyLimit by default) of the request bodies read by the
+	// handlers, added as "request_body" to the entries of failed requests
+	// only. The values of the redacted query parameters are redacted from
+	// form and JSON bodies. Gzip and deflate bodies are decompressed, others
+	// (e.g. br) are replaced by a placeholder.
+	CaptureRequestBody bool
+	RequestBodyLimit   int
+	// DebugTrace logs, once per request handled by the middlewares, a Debug
+	// entry with the raw X-Cloud-Trace-Context header and the trace, span
+	// and sampling decision parsed from it, to diagnose entries not linking
+	// to their trace. MinSeverity still applies.
+	DebugTrace bool
+	// ClassifyError returns the severity at which the Error methods log err,
+	// e.g. Warning for expected errors or Critical for data loss, instead of
+	// always Error. Errors classified below Warning are not reported.
+	// Returning Default declares no severity: the Error methods log at
+	// Error, and the middlewares keep the severity of the status. See
+	// ErrorSeverity.
+	ClassifyError func(err error) Severity
+	// ErrorsOnly skips the entries of the requests completed below Warning
+	// in the middlewares, for high volume services that can't afford an
+	// access log, while failed requests keep their full entries.
+	ErrorsOnly bool
+	// MessageKey is the field of the human-readable message in structured
+	// payloads, e.g. "msg". The "message" field of the payloads built by
+	// gcplog, and of the map payloads logged, is renamed to it. Defaults to
+	// "message", which Cloud Logging displays as the summary of the entry.
+	MessageKey string
+	// CreateAttempts and CreateRetryInterval configure the retries of
+	// TryNewGcpLog: the number of attempts (3 by default) and the interval
+	// before the first retry (500ms by default), doubled at each one.
+	CreateAttempts      int
+	CreateRetryInterval time.Duration
+	// LabelCardinalityLimit, when set, warns once per label key set with
+	// WithLabels (or RegisterContextLabel) whose values look high-cardinality,
+	// as they inflate the cost of log-based metrics: values looking like
+	// UUIDs or long hex ids, or more distinct values than the limit within
+	// LabelCardinalityWindow (a minute by default). The labels are still set.
+	LabelCardinalityLimit  int
+	LabelCardinalityWindow time.Duration
+	// FlushEvery, when set, sends the entries in groups of FlushEvery, the
+	// logging client buffering them and gcplog flushing after every
+	// FlushEvery entries rather than after each one. Meant for tests, see
+	// gcplogtest.Server.FlushEvery. It also sets BufferEntryCountThreshold
+	// when that is zero.
+	FlushEvery int
+	// LatencyFields returns the fields of the latency of a request in the
+	// StructuredRequestLog payloads. Defaults to a readable "latency" string,
+	// e.g. "123.4ms", and a numeric "latency_ms" for log-based metrics.
+	LatencyFields func(latency time.Duration) map[string]interface{}
+	// StaticLabels are added to every entry, e.g. the "version", "commit" and
+	// "build_time" of the release, to correlate the logs with it. They are
+	// set at construction and kept by Reconfigure.
+	StaticLabels map[string]string
+	// IDGenerator generates the request, operation and batch ids, e.g. ULIDs,
+	// or a counter in tests asserting exact entries. Defaults to random
+	// (version 4) UUIDs.
+	IDGenerator func() string
 }
 
+// DefaultMaxPayloadSize leaves room under the 256KB limit of Cloud Logging
+// for the rest of the entry.
+const DefaultMaxPayloadSize = 250 * 1024
+
+// Log ids of common runtimes, under which their consoles expect the logs.
+const (
+	CloudRunStdoutLogID   = "run.googleapis.com/stdout"
+	CloudRunRequestsLogID = "run.googleapis.com/requests"
+	AppEngineStdoutLogID  = "appengine.googleapis.com/stdout"
+	AppEngineRequestLogID = "appengine.googleapis.com/request_log"
+	CloudFunctionsLogID   = "cloudfunctions.googleapis.com/cloud-functions"
+)
+
 type ResponseMetadata struct {
 	Status  int
 	Size    int
 	Latency time.Duration
+	// Sequence is the number of the request when
+	// GcpLogOptions.RequestSequence is set, zero otherwise.
+	Sequence uint64
 }
 
 // type GcpLog interface {
@@ -40,40 +288,159 @@ type ResponseMetadata struct {
 	Constructor
 */
 
+// GcpLog writes entries to Cloud Logging and reports errors to Error
+// Reporting. All of its public methods are no-ops on a nil *GcpLog, so
+// optional logging can be expressed with a nil pointer.
 type GcpLog struct {
 	projectId     string
 	serviceName   string
 	loggingClient *logging.Client
 	errorClient   *errorreporting.Client
 	logger        *logging.Logger
-	options       *GcpLogOptions
+	config        *config
+	stop          chan struct{}
+	errorQueue    *errorQueue
+	labels        map[string]string
+	aggregator    *errorAggregator
+	// closer is shared with the loggers derived by Named and WithLabels.
+	closer      *closer
+	loggers     *loggerCache
+	protoWriter *protoWriter
+	// logName is the full name of the log of logger, see LogProto.
+	logName     string
+	cardinality *cardinalityGuard
+	projects    *projectLoggers
+	// trace, span and traceSampled override the trace of the entries, see
+	// LogWithTrace and GcpLogOptions.SpanContext.
+	trace        string
+	span         string
+	traceSampled bool
+	// endsOperation marks the entries as the last of their operation.
+	endsOperation bool
+	// timestamp overrides the timestamp of the entries, see Timestamped.
+	timestamp time.Time
+	// userExtractor overrides ExtractUserFromRequest, see WithUserExtractor.
+	userExtractor func(r *http.Request) string
+}
+
+// loggerCache memoizes the loggers of the log names written by LogTo and
+// Named, shared by all the loggers derived from the same client.
+type loggerCache struct {
+	mu      sync.Mutex
+	loggers map[string]*logging.Logger
+	// logged counts the entries logged, see GcpLogOptions.FlushEvery.
+	logged uint64
+}
+
+type closer struct {
+	once   sync.Once
+	closed int32
+
+	// counting are the CountingLoggers not stopped yet, stopped by Close.
+	mu       sync.Mutex
+	counting map[*CountingLogger]struct{}
 }
 
 func NewGcpLog(projectId string, serviceName string, options GcpLogOptions) GcpLog {
+	return NewGcpLogContext(context.Background(), projectId, serviceName, options)
+}
+
+// NewGcpLogContext is like NewGcpLog but dials the clients with ctx, e.g. to
+// bound the startup with a timeout. The error reporting client keeps using
+// the values of ctx but not its cancellation, since it sends the reports
+// with the context it is created with.
+func NewGcpLogContext(ctx context.Context, projectId string, serviceName string, options GcpLogOptions) GcpLog {
 
 	if projectId == "" || serviceName == "" {
 		panic("Gcp log not correctly initialized.")
 	}
 
-	ctx := context.Background()
+	instance, err := newGcpLog(ctx, projectId, serviceName, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return instance
+}
+
+// TryNewGcpLog is like NewGcpLogContext but returns an error instead of
+// exiting when the logger can't be created, after retrying for transient
+// failures (e.g. a metadata server hiccup at startup) as configured by
+// CreateAttempts and CreateRetryInterval. An empty projectId is resolved as
+// by NewGcpLogAuto.
+func TryNewGcpLog(ctx context.Context, projectId string, serviceName string, options GcpLogOptions) (*GcpLog, error) {
+	if serviceName == "" {
+		return nil, errors.New("gcplog: empty service name")
+	}
+	attempts := options.CreateAttempts
+	if attempts <= 0 {
+		attempts = defaultCreateAttempts
+	}
+	interval := options.CreateRetryInterval
+	if interval <= 0 {
+		interval = defaultCreateRetryInterval
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var instance GcpLog
+		instance, err = tryNewGcpLog(ctx, projectId, serviceName, options)
+		if err == nil {
+			return &instance, nil
+		}
+		if attempt == attempts {
+			return nil, err
+		}
+		select {
+		case <-time.After(interval):
+			interval *= 2
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v (%w)", err, ctx.Err())
+		}
+	}
+}
+
+const (
+	defaultCreateAttempts      = 3
+	defaultCreateRetryInterval = 500 * time.Millisecond
+)
+
+func tryNewGcpLog(ctx context.Context, projectId string, serviceName string, options GcpLogOptions) (GcpLog, error) {
+	if projectId == "" {
+		var err error
+		if projectId, err = detectProjectId(); err != nil {
+			return GcpLog{}, err
+		}
+	}
+	return newGcpLog(ctx, projectId, serviceName, options)
+}
 
+func newGcpLog(ctx context.Context, projectId string, serviceName string, options GcpLogOptions) (GcpLog, error) {
 	// Creates a Logging client.
-	loggingClient, err := logging.NewClient(ctx, projectId)
+	loggingClient, err := logging.NewClient(ctx, projectId, options.ClientOptions...)
 	if err != nil {
-		log.Fatalf("Failed to create logging client: %v", err)
+		return GcpLog{}, fmt.Errorf("Failed to create logging client: %v", err)
+	}
+	config := newConfig(&options)
+	loggingClient.OnError = func(err error) {
+		handleError(config.load(), "Could not write log", err)
 	}
 	// Selects the log to write to.
-	logger := loggingClient.Logger(serviceName)
+	logID := options.LogID
+	if logID == "" {
+		logID = serviceName
+	}
+	logger := loggingClient.Logger(logID, loggerOptions(&options)...)
 
 	// Creates a Error reporting client.
-	errorClient, err := errorreporting.NewClient(ctx, projectId, errorreporting.Config{
+	errorClient, err := errorreporting.NewClient(detachedContext{ctx}, projectId, errorreporting.Config{
 		ServiceName: serviceName,
 		OnError: func(err error) {
-			log.Printf("Could not log error: %v", err)
+			handleError(config.load(), "Could not log error", err)
 		},
-	})
+	}, options.ClientOptions...)
 	if err != nil {
-		log.Fatalf("Failed to create error reporting client: %v", err)
+		loggingClient.Close()
+		return GcpLog{}, fmt.Errorf("Failed to create error reporting client: %v", err)
 	}
 
 	instance := GcpLog{
@@ -82,146 +449,841 @@ func NewGcpLog(projectId string, serviceName string, options GcpLogOptions) GcpL
 		loggingClient: loggingClient,
 		errorClient:   errorClient,
 		logger:        logger,
-		options:       &options,
+		config:        config,
+		stop:          make(chan struct{}),
+		closer:        &closer{},
+		loggers:       &loggerCache{loggers: map[string]*logging.Logger{logID: logger}},
+		protoWriter:   newProtoWriter(projectId, options.ClientOptions),
+		logName:       logName(projectId, logID),
+		cardinality:   newCardinalityGuard(),
+		projects:      newProjectLoggers(),
 	}
-	return instance
+	if len(options.StaticLabels) > 0 {
+		instance = *instance.withLabels(options.StaticLabels)
+	}
+	if options.ErrorReportWindow > 0 {
+		instance.aggregator = newErrorAggregator(options.ErrorReportWindow, options.ErrorReportKey)
+	}
+	if options.FlushInterval > 0 {
+		go instance.flushEvery(options.FlushInterval)
+	}
+	if options.ErrorQueueSize > 0 {
+		instance.errorQueue = newErrorQueue(options.ErrorQueueSize)
+	}
+	return instance, nil
+}
+
+// NewGcpLogAuto is like NewGcpLog but resolves the project id from the
+// GOOGLE_CLOUD_PROJECT environment variable or, when running on GCP, from the
+// metadata server. It panics if the project id can't be determined.
+func NewGcpLogAuto(serviceName string, options GcpLogOptions) GcpLog {
+	projectId, err := detectProjectId()
+	if err != nil {
+		panic(fmt.Sprintf("Gcp log not correctly initialized: %v", err))
+	}
+	return NewGcpLog(projectId, serviceName, options)
+}
+
+func detectProjectId() (string, error) {
+	for _, env := range []string{"GOOGLE_CLOUD_PROJECT", "GCP_PROJECT", "GCLOUD_PROJECT"} {
+		if projectId := os.Getenv(env); projectId != "" {
+			return projectId, nil
+		}
+	}
+	if !metadata.OnGCE() {
+		return "", fmt.Errorf("project id not set in GOOGLE_CLOUD_PROJECT and metadata server not available")
+	}
+	projectId, err := metadata.ProjectID()
+	if err != nil {
+		return "", fmt.Errorf("could not read project id from metadata server: %v", err)
+	}
+	return projectId, nil
 }
 
 /*
 	Public methods
 */
 
+// Close flushes and closes the clients. It is idempotent and safe to call
+// concurrently; entries logged after Close are discarded.
 func (g *GcpLog) Close() {
-	errLogging := g.loggingClient.Close()
-	errError := g.errorClient.Close()
-	if errLogging != nil || errError != nil {
-		log.Printf("Failed to close client: %v, %v", errLogging, errError)
+	if g == nil {
+		return
+	}
+	g.closer.once.Do(g.close)
+}
+
+func (g *GcpLog) close() {
+	// The pending counts, queued reports and aggregated repeats are sent
+	// while the logger is still open.
+	for _, c := range g.closer.countingLoggers() {
+		c.Stop()
+	}
+	if g.errorQueue != nil {
+		g.errorQueue.close(g.options())
+	}
+	if g.aggregator != nil {
+		g.aggregator.close()
+	}
+	atomic.StoreInt32(&g.closer.closed, 1)
+	close(g.stop)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errLogging := g.loggingClient.Close()
+		errError := g.errorClient.Close()
+		if errLogging != nil || errError != nil {
+			log.Printf("Failed to close client: %v, %v", errLogging, errError)
+		}
+		if err := g.protoWriter.close(); err != nil {
+			log.Printf("Failed to close client: %v", err)
+		}
+		if err := g.projects.close(); err != nil {
+			log.Printf("Failed to close client: %v", err)
+		}
+	}()
+
+	if g.options().DrainTimeout <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(g.options().DrainTimeout):
+		log.Printf("Failed to close client: drain timed out after %v", g.options().DrainTimeout)
+	}
+}
+
+// FlushErrors delivers the buffered error reports without closing the
+// clients. It is safe to call repeatedly.
+func (g *GcpLog) FlushErrors() {
+	if g == nil || g.isClosed() {
+		return
+	}
+	g.errorClient.Flush()
+}
+
+// FlushLogs delivers the buffered log entries, of all the logs written,
+// without closing the clients.
+// It is safe to call repeatedly.
+func (g *GcpLog) FlushLogs() error {
+	if g == nil || g.isClosed() {
+		return nil
+	}
+	g.loggers.mu.Lock()
+	loggers := make([]*logging.Logger, 0, len(g.loggers.loggers))
+	for _, logger := range g.loggers.loggers {
+		loggers = append(loggers, logger)
+	}
+	g.loggers.mu.Unlock()
+
+	var err error
+	for _, logger := range loggers {
+		if flushErr := logger.Flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	if flushErr := g.projects.flush(); flushErr != nil {
+		err = flushErr
 	}
+	return err
+}
+
+// Flush delivers the buffered log entries and error reports, returning an
+// error if ctx is done before they are delivered. The underlying flush keeps
+// running in the background in that case, but shutdown is not held past the
+// deadline.
+func (g *GcpLog) Flush(ctx context.Context) error {
+	if g == nil || g.isClosed() {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		g.FlushErrors()
+		done <- g.FlushLogs()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("flush timed out: %w", ctx.Err())
+	}
+}
+
+// Named returns a logger for a component of the service. Its entries are
+// written under the log name "serviceName.component" and it shares the
+// clients of g, so it must not be closed on its own.
+func (g *GcpLog) Named(component string) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	named := *g
+	named.serviceName = g.serviceName + "." + component
+	named.logger = g.namedLogger(named.serviceName)
+	named.logName = logName(g.projectId, named.serviceName)
+	return &named
+}
+
+// WithLabels returns a logger that adds labels to every entry it writes, on
+// top of the labels of g. It shares the clients of g, so it must not be
+// closed on its own.
+func (g *GcpLog) WithLabels(labels map[string]string) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	if limit := g.options().LabelCardinalityLimit; limit > 0 {
+		g.cardinality.check(labels, limit, g.options().LabelCardinalityWindow)
+	}
+	return g.withLabels(labels)
+}
+
+// withLabels is WithLabels for the labels set by gcplog, some of them
+// unique by design, which skip the cardinality guard.
+func (g *GcpLog) withLabels(labels map[string]string) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	scoped := *g
+	scoped.labels = make(map[string]string, len(g.labels)+len(labels))
+	for k, v := range g.labels {
+		scoped.labels[k] = v
+	}
+	for k, v := range labels {
+		scoped.labels[k] = v
+	}
+	return &scoped
 }
 
 // LOG
 
 func (g *GcpLog) Log(log interface{}) {
-	go g.log(log, nil, nil, logging.Info)
+	g.AtRM(logging.Info, log, nil, nil)
 }
 
 func (g *GcpLog) LogR(log interface{}, request *http.Request) {
-	go g.log(log, request, nil, logging.Info)
+	g.AtRM(logging.Info, log, request, nil)
 }
 
 func (g *GcpLog) LogRM(log interface{}, request *http.Request, responseMeta *ResponseMetadata) {
-	go g.log(log, request, responseMeta, logging.Info)
+	g.AtRM(logging.Info, log, request, responseMeta)
 }
 
-// WARN
+// At logs payload at severity, for severities computed at runtime, e.g. from
+// an upstream status. Errors are logged as by Warn and Error, and reported
+// from Warning up.
+func (g *GcpLog) At(severity Severity, payload interface{}) {
+	g.AtRM(severity, payload, nil, nil)
+}
 
-func (g *GcpLog) Warn(err error) {
-	go g.log(err, nil, nil, logging.Warning)
+func (g *GcpLog) AtR(severity Severity, payload interface{}, request *http.Request) {
+	g.AtRM(severity, payload, request, nil)
+}
 
-	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, nil)
+func (g *GcpLog) AtRM(severity Severity, payload interface{}, request *http.Request, responseMeta *ResponseMetadata) {
+	if g == nil {
+		return
+	}
+	err, ok := payload.(error)
+	if !ok {
+		go g.log(payload, request, responseMeta, severity)
+		return
+	}
+	go g.log(errorPayload(err), request, responseMeta, severity)
+
+	if severity >= logging.Warning && os.Getenv("GO_ENV") == "production" {
+		g.errAsync(err, request, debug.Stack())
 	}
 }
 
-func (g *GcpLog) WarnR(err error, request *http.Request) {
-	go g.log(err, request, nil, logging.Warning)
+// LogBatch writes payloads as a single Info entry with an
+// {"items": [...], "count": n} payload, labelled with "batch_id" and
+// "batch_count" for filtering.
+func (g *GcpLog) LogBatch(payloads []interface{}) {
+	if g == nil {
+		return
+	}
+	items := make([]interface{}, len(payloads))
+	for i, payload := range payloads {
+		items[i] = g.toPayload(payload)
+	}
+	batch := g.withLabels(map[string]string{
+		"batch_id":    g.newID(),
+		"batch_count": strconv.Itoa(len(payloads)),
+	})
+	go batch.log(map[string]interface{}{
+		"items": items,
+		"count": len(payloads),
+	}, nil, nil, logging.Info)
+}
 
-	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, request)
+// LogTo writes payload at severity to the log logName instead of the service
+// log, e.g. to keep audit entries in a dedicated "audit" log.
+func (g *GcpLog) LogTo(logName string, payload interface{}, severity Severity) {
+	if g == nil {
+		return
 	}
+	to := *g
+	to.logger = g.namedLogger(logName)
+	go to.log(payload, nil, nil, severity)
 }
 
-func (g *GcpLog) WarnRM(err error, request *http.Request, responseMeta *ResponseMetadata) {
-	go g.log(err, request, responseMeta, logging.Warning)
+// LogWithTrace is like Log but sets the trace of the entry to traceID, e.g.
+// from an upstream system using a non-standard header, instead of parsing it
+// from a request. An invalid id (32 hex characters are expected) is ignored
+// with a warning.
+func (g *GcpLog) LogWithTrace(traceID string, payload interface{}) {
+	if g == nil {
+		return
+	}
+	traced := *g
+	if traceIDRegex.MatchString(traceID) {
+		traced.trace = fmt.Sprintf("projects/%s/traces/%s", g.projectId, traceID)
+	} else {
+		log.Printf("Ignoring invalid trace id %q", traceID)
+	}
+	go traced.log(payload, nil, nil, logging.Info)
+}
 
-	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, request)
+// DEBUG
+
+func (g *GcpLog) Debug(log interface{}) {
+	if g == nil {
+		return
 	}
+	go g.log(log, nil, nil, logging.Debug)
+}
+
+func (g *GcpLog) DebugR(log interface{}, request *http.Request) {
+	if g == nil {
+		return
+	}
+	go g.log(log, request, nil, logging.Debug)
+}
+
+// DebugCtx is like DebugR for the request read from ctx, see LogCtx.
+func (g *GcpLog) DebugCtx(ctx context.Context, log interface{}) {
+	if g == nil {
+		return
+	}
+	go g.withContext(ctx).log(log, requestFromContext(ctx), nil, logging.Debug)
+}
+
+// WARN
+
+func (g *GcpLog) Warn(err error) {
+	g.WarnRM(err, nil, nil)
+}
+
+func (g *GcpLog) WarnR(err error, request *http.Request) {
+	g.WarnRM(err, request, nil)
+}
+
+// WarnRM logs err at Warning. A nil err is ignored, as by all the Warn and
+// Error methods.
+func (g *GcpLog) WarnRM(err error, request *http.Request, responseMeta *ResponseMetadata) {
+	if err == nil {
+		return
+	}
+	g.AtRM(logging.Warning, err, request, responseMeta)
 }
 
 // ERROR
 
 func (g *GcpLog) Error(err error) {
-	go g.log(err.Error(), nil, nil, logging.Error)
+	g.ErrorRM(err, nil, nil)
+}
 
-	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, nil)
+func (g *GcpLog) ErrorR(err error, request *http.Request) {
+	g.ErrorRM(err, request, nil)
+}
+
+// ErrorRM logs err at its SeverityOf. A nil err is ignored, so that
+// `return g.ErrorReturn(err)` needs no check.
+func (g *GcpLog) ErrorRM(err error, request *http.Request, responseMeta *ResponseMetadata) {
+	if err == nil {
+		return
 	}
+	g.AtRM(g.SeverityOf(err), err, request, responseMeta)
 }
 
-func (g *GcpLog) ErrorR(err error, request *http.Request) {
-	go g.log(err.Error(), request, nil, logging.Error)
+// SeverityOf is the severity of err logged by the Error methods, see
+// ClassifyError.
+func (g *GcpLog) SeverityOf(err error) Severity {
+	if g != nil && g.options().ClassifyError != nil {
+		if severity := g.options().ClassifyError(err); severity != logging.Default {
+			return severity
+		}
+	}
+	return logging.Error
+}
 
-	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, request)
+// CONTEXT
+
+// LogCtx is like LogR for the request handled by the middlewares, read from
+// ctx (the request context or one derived from it), so that entries logged
+// inside a handler get its trace and user without passing the request
+// around. Without a request in ctx it is like Log. With Gin, pass
+// c.Request.Context().
+func (g *GcpLog) LogCtx(ctx context.Context, log interface{}) {
+	if g == nil {
+		return
 	}
+	go g.withContext(ctx).log(log, requestFromContext(ctx), nil, logging.Info)
 }
 
-func (g *GcpLog) ErrorRM(err error, request *http.Request, responseMeta *ResponseMetadata) {
-	go g.log(err.Error(), request, responseMeta, logging.Error)
+// WarnCtx is like WarnR for the request read from ctx, see LogCtx.
+func (g *GcpLog) WarnCtx(ctx context.Context, err error) {
+	if g == nil || err == nil {
+		return
+	}
+	request := requestFromContext(ctx)
+	go g.withContext(ctx).log(errorPayload(err), request, nil, logging.Warning)
 
 	if os.Getenv("GO_ENV") == "production" {
-		go g.err(err, request)
+		g.errAsync(err, request, debug.Stack())
+	}
+}
+
+// ErrorCtx is like ErrorR for the request read from ctx, see LogCtx.
+func (g *GcpLog) ErrorCtx(ctx context.Context, err error) {
+	if g == nil || err == nil {
+		return
+	}
+	request := requestFromContext(ctx)
+	severity := g.SeverityOf(err)
+	go g.withContext(ctx).log(errorPayload(err), request, nil, severity)
+
+	if severity >= logging.Warning && os.Getenv("GO_ENV") == "production" {
+		g.errAsync(err, request, debug.Stack())
+	}
+}
+
+// SYNC
+
+// LogSync is like Log but writes and flushes the entry before returning, so
+// it is delivered even if the process exits right after. It blocks for a
+// round trip to Cloud Logging: use it on shutdown or fatal paths only.
+func (g *GcpLog) LogSync(log interface{}) {
+	if g == nil {
+		return
+	}
+	g.log(log, nil, nil, logging.Info)
+}
+
+// ErrorSync is like Error but delivers the entry and the error report before
+// returning, at the cost of blocking for the round trips.
+func (g *GcpLog) ErrorSync(err error) {
+	if g == nil || err == nil {
+		return
+	}
+	severity := g.SeverityOf(err)
+	g.log(errorPayload(err), nil, nil, severity)
+
+	if severity >= logging.Warning && os.Getenv("GO_ENV") == "production" {
+		g.err(err, nil, debug.Stack())
 	}
 }
 
+// Ping writes a Debug sentinel entry and waits for its delivery, returning
+// the error of Cloud Logging if any, e.g. for readiness probes to detect
+// missing credentials or permissions (logging.logEntries.create) at startup
+// rather than silently dropping every entry.
+func (g *GcpLog) Ping(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	if g.isClosed() {
+		return errors.New("gcplog: ping on a closed logger")
+	}
+	return g.logger.LogSync(ctx, logging.Entry{
+		Payload:  "gcplog ping",
+		Severity: logging.Debug,
+		Labels:   map[string]string{"gcplog_ping": "true"},
+	})
+}
+
+// RETURN
+
+// ErrorReturn logs err like Error and returns it, for inline use as in
+// `return g.ErrorReturn(err)`.
+func (g *GcpLog) ErrorReturn(err error) error {
+	g.Error(err)
+	return err
+}
+
+func (g *GcpLog) ErrorReturnR(err error, request *http.Request) error {
+	g.ErrorR(err, request)
+	return err
+}
+
+// WarnReturn logs err like Warn and returns it.
+func (g *GcpLog) WarnReturn(err error) error {
+	g.Warn(err)
+	return err
+}
+
+func (g *GcpLog) WarnReturnR(err error, request *http.Request) error {
+	g.WarnR(err, request)
+	return err
+}
+
 /*
 	Internal methods
 */
 
 func (g *GcpLog) log(payload interface{}, request *http.Request, responseMeta *ResponseMetadata, severity logging.Severity) {
-	if os.Getenv("GO_ENV") == "development" && g.options.DevelopmentLogger != nil {
-		g.options.DevelopmentLogger.Println(payload)
+	if g.isClosed() || !g.enabled(severity, request) {
+		return
+	}
+	if os.Getenv("GO_ENV") == "development" && g.options().DevelopmentLogger != nil {
+		g.options().DevelopmentLogger.Println(payload)
 	} else {
-		defer g.logger.Flush()
+		logger := g.logger
+		if g.options().SeverityLogID != nil {
+			if logID := g.options().SeverityLogID(severity); logID != "" {
+				logger = g.namedLogger(logID)
+			}
+		}
+		flushEvery := g.options().FlushEvery
+		if flushEvery > 0 {
+			defer func() {
+				if atomic.AddUint64(&g.loggers.logged, 1)%uint64(flushEvery) == 0 {
+					g.FlushLogs()
+				}
+			}()
+		} else if !isBatched(request) {
+			defer logger.Flush()
+		}
 		entry := logging.Entry{
-			Payload:  payload,
-			Severity: severity,
+			Timestamp: g.timestamp,
+			Payload:   g.toPayload(payload),
+			Severity:  severity,
 		}
 		if request != nil {
-			httpRequest := parseRequest(request, responseMeta)
+			httpRequest := parseRequest(g.loggedRequest(request), responseMeta, g.clientIPHeaders())
 			entry.HTTPRequest = &httpRequest
 			trace, span, traceSampled := parseTrace(request, g.projectId)
 			entry.Trace = trace
 			entry.SpanID = span
 			entry.TraceSampled = traceSampled
-			if g.options.ExtractUserFromRequest != nil {
-				user := g.options.ExtractUserFromRequest(request)
-				entry.Labels = map[string]string{"user": user}
+		}
+		if g.trace != "" {
+			entry.Trace = g.trace
+			entry.SpanID = g.span
+			entry.TraceSampled = g.traceSampled
+		}
+		entry.Operation = entryOperation(request, g.endsOperation)
+		entry.Labels = g.entryLabels(request, responseMeta)
+		if size := g.truncate(&entry); size > 0 {
+			if entry.Labels == nil {
+				entry.Labels = map[string]string{}
 			}
+			entry.Labels["truncated"] = "true"
+			entry.Labels["original_size"] = strconv.Itoa(size)
 		}
-		g.logger.Log(entry)
+		if entry.Trace != "" {
+			if entry.Labels == nil {
+				entry.Labels = map[string]string{}
+			}
+			traceID := entry.Trace[strings.LastIndex(entry.Trace, "/")+1:]
+			entry.Labels[g.traceLabelKey()] = traceID
+			entry.Labels["trace_sampled"] = strconv.FormatBool(entry.TraceSampled)
+			if onAppEngine {
+				entry.Labels[appEngineTraceLabel] = traceID
+			}
+		}
+		logger.Log(entry)
+	}
+
+	if g.options().AfterLog != nil {
+		g.options().AfterLog(severity, request != nil)
 	}
-	
 }
 
-func (g *GcpLog) err(err error, request *http.Request) {
+// err reports err, with the stack of its deepest StackTracer or else stack,
+// captured by the caller of the logging method before going asynchronous.
+func (g *GcpLog) err(err error, request *http.Request, stack []byte) {
+	if g.options().IgnoreErrorFunc != nil && g.options().IgnoreErrorFunc(err) {
+		return
+	}
+	if errStack := deepestStack(err); errStack != nil {
+		stack = errStack
+	}
+	stack = normalizeStack(stack)
+	err = withRootCause(err)
+	if g.aggregator != nil && !g.aggregator.admit(err, request, stack, g.report) {
+		return
+	}
+	g.report(err, request, stack)
+}
+
+func (g *GcpLog) report(err error, request *http.Request, stack []byte) {
+	if g.isClosed() {
+		return
+	}
 	defer g.errorClient.Flush()
 	errorEntry := errorreporting.Entry{
 		Error: err,
-		Stack: debug.Stack(),
+		Stack: stack,
 	}
 	if request != nil {
-		errorEntry.Req = request
+		errorEntry.Req = g.loggedRequest(request)
 	}
 	g.errorClient.Report(errorEntry)
 }
 
-func parseRequest(r *http.Request, w *ResponseMetadata) logging.HTTPRequest {
+// logID is the log of the service, see GcpLogOptions.LogID.
+func (g *GcpLog) logID() string {
+	if logID := g.options().LogID; logID != "" {
+		return logID
+	}
+	return g.serviceName
+}
+
+func loggerOptions(options *GcpLogOptions) []logging.LoggerOption {
+	var loggerOptions []logging.LoggerOption
+	if options.BufferDelayThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.DelayThreshold(options.BufferDelayThreshold))
+	}
+	if options.BufferEntryCountThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.EntryCountThreshold(options.BufferEntryCountThreshold))
+	} else if options.FlushEvery > 0 {
+		loggerOptions = append(loggerOptions, logging.EntryCountThreshold(options.FlushEvery))
+	}
+	if options.BufferEntryByteThreshold > 0 {
+		loggerOptions = append(loggerOptions, logging.EntryByteThreshold(options.BufferEntryByteThreshold))
+	}
+	if options.BufferedByteLimit > 0 {
+		loggerOptions = append(loggerOptions, logging.BufferedByteLimit(options.BufferedByteLimit))
+	}
+	return loggerOptions
+}
 
-	localIp := r.Header.Get("X-Real-Ip")
-	if localIp == "" {
-		localIp = r.Header.Get("X-Forwarded-For")
+func (g *GcpLog) namedLogger(logName string) *logging.Logger {
+	g.loggers.mu.Lock()
+	defer g.loggers.mu.Unlock()
+	logger, ok := g.loggers.loggers[logName]
+	if !ok {
+		logger = g.loggingClient.Logger(logName, loggerOptions(g.options())...)
+		g.loggers.loggers[logName] = logger
+	}
+	return logger
+}
+
+// withBatching marks the entries logged with r to be flushed together at the
+// end of the request.
+func (g *GcpLog) withBatching(r *http.Request) *http.Request {
+	if g.options().DisableRequestBatching {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), batchKey, true))
+}
+
+func isBatched(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	batched, _ := r.Context().Value(batchKey).(bool)
+	return batched
+}
+
+// handleError passes a delivery failure to GcpLogOptions.OnError, or prints
+// it after prefix.
+func handleError(options *GcpLogOptions, prefix string, err error) {
+	if options.OnError != nil {
+		options.OnError(err)
+		return
+	}
+	log.Printf("%s: %v", prefix, err)
+}
+
+// requestLogger returns the logger for the entries of completed requests.
+func (g *GcpLog) requestLogger() *GcpLog {
+	if g.options().RequestLogID == "" {
+		return g
 	}
+	to := *g
+	to.logger = g.namedLogger(g.options().RequestLogID)
+	return &to
+}
+
+// enabled reports whether an entry at severity is logged, per MinSeverity
+// and DebugRequest.
+func (g *GcpLog) enabled(severity logging.Severity, request *http.Request) bool {
+	if severity >= g.options().MinSeverity {
+		return true
+	}
+	return request != nil && g.options().DebugRequest != nil && g.options().DebugRequest(request)
+}
+
+// DebugHeader returns a GcpLogOptions.DebugRequest predicate selecting the
+// requests with the given header set, to a value other than "0" or "false".
+func DebugHeader(name string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		value := r.Header.Get(name)
+		return value != "" && value != "0" && !strings.EqualFold(value, "false")
+	}
+}
+
+func (g *GcpLog) isClosed() bool {
+	return atomic.LoadInt32(&g.closer.closed) == 1
+}
+
+// requestSequence is shared by all the loggers of the process.
+var requestSequence uint64
+
+func (g *GcpLog) nextSequence() uint64 {
+	if !g.options().RequestSequence {
+		return 0
+	}
+	return atomic.AddUint64(&requestSequence, 1)
+}
+
+func (g *GcpLog) traceLabelKey() string {
+	if g.options().TraceLabelKey != "" {
+		return g.options().TraceLabelKey
+	}
+	return "trace_id"
+}
+
+func (g *GcpLog) now() time.Time {
+	if g.options().Clock != nil {
+		return g.options().Clock()
+	}
+	return time.Now()
+}
+
+// flushEvery flushes all the loggers of g, including the ones of Named,
+// LogTo and InProject, every interval until g is closed.
+func (g *GcpLog) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.FlushLogs()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// entryLabels merges the labels of the logger with the ones extracted from
+// the request and the response metadata, if any.
+func (g *GcpLog) entryLabels(r *http.Request, responseMeta *ResponseMetadata) map[string]string {
+	labels := map[string]string{}
+	for k, v := range g.labels {
+		labels[k] = v
+	}
+	if responseMeta != nil {
+		if g.isSlow(responseMeta) {
+			labels["slow"] = "true"
+		}
+		if responseMeta.Sequence > 0 {
+			labels["sequence"] = strconv.FormatUint(responseMeta.Sequence, 10)
+		}
+		if responseMeta.Status > 0 {
+			labels["status_class"] = strconv.Itoa(responseMeta.Status/100) + "xx"
+		}
+		if r != nil {
+			labels["method"] = r.Method
+		}
+		if len(g.options().LatencyBuckets) > 0 {
+			labels["latency_bucket"] = latencyBucket(responseMeta.Latency, g.options().LatencyBuckets)
+		}
+	}
+	if r == nil {
+		return nilIfEmpty(labels)
+	}
+	if user := g.extractUser(r); user != "" {
+		labels["user"] = user
+	}
+	if g.options().GenerateRequestID {
+		if id := RequestID(r); id != "" {
+			labels["request_id"] = id
+		}
+	}
+	for _, name := range g.options().LogHeaders {
+		if value := r.Header.Get(name); value != "" {
+			labels["header."+strings.ToLower(name)] = value
+		}
+	}
+	return nilIfEmpty(labels)
+}
+
+// withUserExtractor returns a logger reading the user of the requests with
+// extractUser instead of ExtractUserFromRequest.
+func (g *GcpLog) withUserExtractor(extractUser func(r *http.Request) string) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	extracting := *g
+	extracting.userExtractor = extractUser
+	return &extracting
+}
+
+func (g *GcpLog) extractUser(r *http.Request) string {
+	if g.options().ExtractUserFromContext != nil {
+		if user := g.options().ExtractUserFromContext(r.Context()); user != "" {
+			return user
+		}
+	}
+	if g.userExtractor != nil {
+		return g.userExtractor(r)
+	}
+	if g.options().ExtractUserFromRequest != nil {
+		return g.options().ExtractUserFromRequest(r)
+	}
+	return ""
+}
+
+func latencyBucket(latency time.Duration, buckets []time.Duration) string {
+	if latency < buckets[0] {
+		return "<" + buckets[0].String()
+	}
+	for i := 1; i < len(buckets); i++ {
+		if latency < buckets[i] {
+			return buckets[i-1].String() + "-" + buckets[i].String()
+		}
+	}
+	return ">=" + buckets[len(buckets)-1].String()
+}
+
+func nilIfEmpty(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+var defaultClientIPHeaders = []string{"X-Real-Ip", "X-Forwarded-For"}
+
+func (g *GcpLog) clientIPHeaders() []string {
+	if len(g.options().ClientIPHeaders) > 0 {
+		return g.options().ClientIPHeaders
+	}
+	return defaultClientIPHeaders
+}
+
+func parseRequest(r *http.Request, w *ResponseMetadata, clientIPHeaders []string) logging.HTTPRequest {
+
+	var localIp string
+	for _, header := range clientIPHeaders {
+		if localIp = r.Header.Get(header); localIp != "" {
+			break
+		}
+	}
+	remoteIp := hostOnly(r.RemoteAddr)
 	if localIp == "" {
-		localIp = r.RemoteAddr
+		localIp = remoteIp
 	}
 
 	request := logging.HTTPRequest{
 		Request:     r,
 		RequestSize: r.ContentLength,
 		LocalIP:     localIp,
-		RemoteIP:    r.RemoteAddr,
+		RemoteIP:    remoteIp,
 	}
 	if w != nil {
 		request.Status = w.Status
@@ -232,24 +1294,53 @@ func parseRequest(r *http.Request, w *ResponseMetadata) logging.HTTPRequest {
 	return request
 }
 
+// traceRegex parses the X-Cloud-Trace-Context header. It is compiled once
+// since parseTrace runs on every request.
+var traceRegex = regexp.MustCompile(
+	// Matches on "TRACE_ID"
+	`([a-f\d]+)?` +
+		// Matches on "/SPAN_ID"
+		`(?:/([a-f\d]+))?` +
+		// Matches on ";0=TRACE_TRUE"
+		`(?:;o=(\d))?`)
+
+// onAppEngine reports whether the service runs on App Engine, whose log
+// viewer nests the entries under their request by the appEngineTraceLabel.
+var onAppEngine = os.Getenv("GAE_APPLICATION") != "" || os.Getenv("GAE_SERVICE") != ""
+
+const appEngineTraceLabel = "appengine.googleapis.com/trace_id"
+
+var traceIDRegex = regexp.MustCompile(`^[a-fA-F\d]{32}$`)
+
+// hostOnly strips the port from an address such as "10.0.0.1:54321" or
+// "[::1]:54321". Addresses without a port, e.g. of unix sockets, are
+// returned as they are, minus IPv6 brackets.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
 func parseTrace(r *http.Request, projectId string) (traceId string, spanId string, traceSampled bool) {
-	var traceRegex = regexp.MustCompile(
-		// Matches on "TRACE_ID"
-		`([a-f\d]+)?` +
-			// Matches on "/SPAN_ID"
-			`(?:/([a-f\d]+))?` +
-			// Matches on ";0=TRACE_TRUE"
-			`(?:;o=(\d))?`)
-	matches := traceRegex.FindStringSubmatch(r.Header.Get("X-Cloud-Trace-Context"))
+	header := r.Header.Get(traceHeader)
+	if header == "" {
+		return "", "", false
+	}
+
+	matches := traceRegex.FindStringSubmatch(header)
+	if len(matches) < 4 {
+		return "", "", false
+	}
 
 	traceId, spanId, traceSampled = matches[1], matches[2], matches[3] == "1"
 
-	if traceId != "" {
-		traceId = fmt.Sprintf("projects/%s/traces/%s", projectId, traceId)
-	}
 	if spanId == "0" {
 		spanId = ""
 	}
+	if traceId != "" {
+		traceId = fmt.Sprintf("projects/%s/traces/%s", projectId, traceId)
+	}
 
 	return
 }
@@ -0,0 +1,25 @@
+package gcplog
+
+import "testing"
+
+func TestHostOnly(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.1:54321", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"[::1]:54321", "::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"@", "@"},
+		{"/var/run/app.sock", "/var/run/app.sock"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := hostOnly(tt.addr); got != tt.want {
+			t.Errorf("hostOnly(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
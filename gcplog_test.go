@@ -0,0 +1,89 @@
+package gcplog_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestCloseConcurrently(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+	named := g.Named("component")
+
+	// Close is called on the root logger only, while the derived one keeps
+	// logging.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			g.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			named.Log("closing")
+		}()
+	}
+	wg.Wait()
+
+	// Entries logged after Close are discarded rather than written to the
+	// closed clients, which would panic.
+	g.LogSync("closed")
+	named.LogSync("closed")
+	g.ErrorSync(errors.New("closed"))
+	g.Close()
+
+	for _, e := range server.Entries() {
+		if e.Payload == "closed" {
+			t.Errorf("got entry %+v logged after Close", e)
+		}
+	}
+}
+
+func TestFlushIntervalFlushesNamedLoggers(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:        server.ClientOptions(),
+		BufferDelayThreshold: time.Minute,
+		FlushInterval:        50 * time.Millisecond,
+	})
+	defer g.Close()
+
+	// The entries of a request are batched until it ends.
+	request := g.StartRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), false)
+	g.Named("component").LogR("named", request.Request())
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	if entries[0].LogName != "projects/project/logs/service.component" {
+		t.Errorf("log name = %q, want the one of the named logger", entries[0].LogName)
+	}
+}
+
+func TestNilErrorIsIgnored(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+
+	g.Error(nil)
+	g.Warn(nil)
+	g.ErrorCtx(context.Background(), nil)
+	g.ErrorSync(nil)
+	if err := g.ErrorReturn(nil); err != nil {
+		t.Errorf("ErrorReturn(nil) = %v, want nil", err)
+	}
+	g.LogSync("marker")
+	g.Close()
+
+	if entries := server.Entries(); len(entries) != 1 {
+		t.Errorf("got %d entries, want only the marker: %+v", len(entries), entries)
+	}
+}
@@ -0,0 +1,250 @@
+// Package gcplogtest provides an in-memory fake of the Cloud Logging and
+// Error Reporting APIs, so the logging behavior of an application can be
+// tested without GCP credentials.
+//
+//	server := gcplogtest.NewServer()
+//	defer server.Close()
+//
+//	logger := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+//		ClientOptions: server.ClientOptions(),
+//	})
+//	logger.Log("hello")
+//	logger.Close()
+//
+//	server.AssertEntry(t, func(e gcplogtest.Entry) bool { return e.Payload == "hello" })
+package gcplogtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/ftognetto/gcplog"
+	"google.golang.org/api/option"
+	erpb "google.golang.org/genproto/googleapis/devtools/clouderrorreporting/v1beta1"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Entry is a log entry received by the fake server.
+type Entry struct {
+	LogName  string
+	Severity logging.Severity
+	// Payload is a string for text payloads and a map[string]interface{} for
+	// structured ones.
+	Payload      interface{}
+	Labels       map[string]string
+	Trace        string
+	SpanID       string
+	TraceSampled bool
+	HTTPRequest  *logtypepb.HttpRequest
+	// Operation groups the entries of a request handled by the middlewares.
+	Operation *logpb.LogEntryOperation
+}
+
+// ErrorEvent is an error report received by the fake server.
+type ErrorEvent struct {
+	Service string
+	Message string
+}
+
+// Server is a fake logging and error reporting server listening in memory.
+type Server struct {
+	listener   *bufconn.Listener
+	grpcServer *grpc.Server
+
+	mu      sync.Mutex
+	entries []Entry
+	errors  []ErrorEvent
+}
+
+// NewServer starts a fake server. It must be stopped with Close.
+func NewServer() *Server {
+	s := &Server{
+		listener:   bufconn.Listen(1024 * 1024),
+		grpcServer: grpc.NewServer(),
+	}
+	logpb.RegisterLoggingServiceV2Server(s.grpcServer, &loggingServer{server: s})
+	erpb.RegisterReportErrorsServiceServer(s.grpcServer, &errorServer{server: s})
+	go s.grpcServer.Serve(s.listener)
+	return s
+}
+
+// ClientOptions point the clients at the fake server, to be set as
+// gcplog.GcpLogOptions.ClientOptions.
+func (s *Server) ClientOptions() []option.ClientOption {
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return s.listener.Dial()
+	}
+	return []option.ClientOption{
+		option.WithEndpoint("bufnet"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithContextDialer(dialer)),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
+}
+
+// FlushEvery returns the options of a logger writing to the server which
+// sends its entries in groups of n, so that tests wait for them
+// deterministically with WaitForEntries rather than sleeping.
+func (s *Server) FlushEvery(n int) gcplog.GcpLogOptions {
+	return gcplog.GcpLogOptions{
+		ClientOptions: s.ClientOptions(),
+		FlushEvery:    n,
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.grpcServer.Stop()
+}
+
+// Entries returns the log entries received so far.
+func (s *Server) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Entry(nil), s.entries...)
+}
+
+// Errors returns the error reports received so far.
+func (s *Server) Errors() []ErrorEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ErrorEvent(nil), s.errors...)
+}
+
+// Reset discards the received entries and error reports.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = nil
+	s.errors = nil
+}
+
+// WaitForEntries waits until at least n entries are received, failing t
+// after timeout. Entries are written asynchronously by gcplog, so tests
+// should wait for them rather than sleep.
+func (s *Server) WaitForEntries(t testing.TB, n int, timeout time.Duration) []Entry {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		entries := s.Entries()
+		if len(entries) >= n {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gcplogtest: got %d entries, want at least %d", len(entries), n)
+			return entries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitForErrors is like WaitForEntries for the error reports.
+func (s *Server) WaitForErrors(t testing.TB, n int, timeout time.Duration) []ErrorEvent {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		errors := s.Errors()
+		if len(errors) >= n {
+			return errors
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gcplogtest: got %d error reports, want at least %d", len(errors), n)
+			return errors
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AssertEntry fails t if no received entry matches.
+func (s *Server) AssertEntry(t testing.TB, match func(e Entry) bool) Entry {
+	t.Helper()
+	for _, e := range s.Entries() {
+		if match(e) {
+			return e
+		}
+	}
+	t.Errorf("gcplogtest: no matching entry among %d received", len(s.Entries()))
+	return Entry{}
+}
+
+// AssertSeverity fails t if no received entry has the given severity.
+func (s *Server) AssertSeverity(t testing.TB, severity logging.Severity) Entry {
+	t.Helper()
+	return s.AssertEntry(t, func(e Entry) bool { return e.Severity == severity })
+}
+
+// AssertLabel fails t if no received entry has the label key set to value.
+func (s *Server) AssertLabel(t testing.TB, key, value string) Entry {
+	t.Helper()
+	return s.AssertEntry(t, func(e Entry) bool { return e.Labels[key] == value })
+}
+
+// AssertTrace fails t if no received entry has the given trace.
+func (s *Server) AssertTrace(t testing.TB, trace string) Entry {
+	t.Helper()
+	return s.AssertEntry(t, func(e Entry) bool { return e.Trace == trace })
+}
+
+type loggingServer struct {
+	logpb.UnimplementedLoggingServiceV2Server
+	server *Server
+}
+
+func (l *loggingServer) WriteLogEntries(ctx context.Context, req *logpb.WriteLogEntriesRequest) (*logpb.WriteLogEntriesResponse, error) {
+	l.server.mu.Lock()
+	defer l.server.mu.Unlock()
+	for _, e := range req.Entries {
+		entry := Entry{
+			LogName:      req.LogName,
+			Severity:     logging.Severity(e.Severity),
+			Labels:       map[string]string{},
+			Trace:        e.Trace,
+			SpanID:       e.SpanId,
+			TraceSampled: e.TraceSampled,
+			HTTPRequest:  e.HttpRequest,
+			Operation:    e.Operation,
+		}
+		if e.LogName != "" {
+			entry.LogName = e.LogName
+		}
+		for k, v := range req.Labels {
+			entry.Labels[k] = v
+		}
+		for k, v := range e.Labels {
+			entry.Labels[k] = v
+		}
+		switch payload := e.Payload.(type) {
+		case *logpb.LogEntry_TextPayload:
+			entry.Payload = payload.TextPayload
+		case *logpb.LogEntry_JsonPayload:
+			entry.Payload = payload.JsonPayload.AsMap()
+		case *logpb.LogEntry_ProtoPayload:
+			entry.Payload = payload.ProtoPayload
+		}
+		l.server.entries = append(l.server.entries, entry)
+	}
+	return &logpb.WriteLogEntriesResponse{}, nil
+}
+
+type errorServer struct {
+	erpb.UnimplementedReportErrorsServiceServer
+	server *Server
+}
+
+func (e *errorServer) ReportErrorEvent(ctx context.Context, req *erpb.ReportErrorEventRequest) (*erpb.ReportErrorEventResponse, error) {
+	e.server.mu.Lock()
+	defer e.server.mu.Unlock()
+	event := ErrorEvent{Message: req.Event.GetMessage()}
+	if req.Event.GetServiceContext() != nil {
+		event.Service = req.Event.ServiceContext.Service
+	}
+	e.server.errors = append(e.server.errors, event)
+	return &erpb.ReportErrorEventResponse{}, nil
+}
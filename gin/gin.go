@@ -0,0 +1,76 @@
+// Package gin provides the gcplog middleware for the Gin web framework,
+// kept in a module of its own so that gcplog doesn't depend on Gin.
+package gin
+
+import (
+	"strconv"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/gin-gonic/gin"
+)
+
+type bodyLogWriter struct {
+	gin.ResponseWriter
+	request *gcplog.RequestLog
+}
+
+func (w *bodyLogWriter) Write(b []byte) (int, error) {
+	w.request.CaptureBody(w.Header(), b)
+	return w.ResponseWriter.Write(b)
+}
+
+type GinOptions struct {
+	// SkipBody disables the capture of the response body, which is otherwise
+	// duplicated into a buffer to build the error of failed requests. Errors
+	// are then built from c.Errors only, and responses are streamed with no
+	// overhead.
+	SkipBody bool
+}
+
+func Gin(g *gcplog.GcpLog) gin.HandlerFunc {
+	return GinCustom(g, GinOptions{})
+}
+
+func GinCustom(g *gcplog.GcpLog, options GinOptions) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		// before request
+		request := g.StartRequest(c.Writer, c.Request, !options.SkipBody)
+		c.Request = request.Request()
+		if !options.SkipBody {
+			c.Writer = &bodyLogWriter{ResponseWriter: c.Writer, request: request}
+		}
+
+		defer func() {
+
+			// after request
+			var err error
+			if len(c.Errors) > 0 {
+				err = c.Errors.Last().Err
+			}
+			labels := map[string]string{
+				"method": c.Request.Method,
+				"status": strconv.Itoa(c.Writer.Status()),
+			}
+			// Unmatched requests have no route.
+			if route := c.FullPath(); route != "" {
+				labels["route"] = route
+			}
+			for k, v := range request.ResponseLabels(c.Writer.Header()) {
+				labels[k] = v
+			}
+			request.End(c.Request, gcplog.RequestOutcome{
+				Status: c.Writer.Status(),
+				Size:   c.Writer.Size(),
+				Route:  c.FullPath(),
+				Err:    err,
+				// The errors of c.Errors are the application ones.
+				ClassifyErr: true,
+				Labels:      labels,
+			})
+		}()
+
+		c.Next()
+	}
+}
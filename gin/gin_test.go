@@ -0,0 +1,70 @@
+package gin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+	gcpgin "github.com/ftognetto/gcplog/gin"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestGinRouteLabel(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions: server.ClientOptions(),
+	})
+
+	router := gin.New()
+	router.Use(gcpgin.Gin(&g))
+	router.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	entries := server.WaitForEntries(t, 2, 5*time.Second)
+	g.Close()
+	for _, e := range entries {
+		route, ok := e.Labels["route"]
+		switch e.Labels["status"] {
+		case "200":
+			if route != "/users/:id" {
+				t.Errorf("got route label %q, want /users/:id", route)
+			}
+		case "404":
+			if ok {
+				t.Errorf("got route label %q on an unmatched request, want none", route)
+			}
+		}
+	}
+}
+
+func TestGinResponseLabelHeaders(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:        server.ClientOptions(),
+		ResponseLabelHeaders: []string{"X-Cache"},
+	})
+
+	router := gin.New()
+	router.Use(gcpgin.Gin(&g))
+	router.GET("/", func(c *gin.Context) {
+		c.Header("X-Cache", "HIT")
+		c.String(http.StatusOK, "ok")
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	server.WaitForEntries(t, 1, 5*time.Second)
+	g.Close()
+	server.AssertLabel(t, "response_header.x-cache", "HIT")
+}
@@ -0,0 +1,13 @@
+module github.com/ftognetto/gcplog/gin
+
+go 1.16
+
+require (
+	github.com/ftognetto/gcplog v1.0.0
+	github.com/gin-gonic/gin v1.7.4
+	github.com/stretchr/testify v1.7.1 // indirect
+)
+
+// Local development against the root module in this repository; ignored by
+// consumers, who get the required release.
+replace github.com/ftognetto/gcplog => ../
@@ -3,8 +3,13 @@ module github.com/ftognetto/gcplog
 go 1.16
 
 require (
+	cloud.google.com/go v0.92.2
 	cloud.google.com/go/errorreporting v0.1.0
 	cloud.google.com/go/logging v1.4.2
-	github.com/gin-gonic/gin v1.7.4
-	google.golang.org/genproto v0.0.0-20210831024726-fe130286e0e2 // indirect
+	github.com/google/go-cmp v0.5.7 // indirect
+	golang.org/x/sys v0.0.0-20210903071746-97244b99971b // indirect
+	google.golang.org/api v0.54.0
+	google.golang.org/genproto v0.0.0-20210831024726-fe130286e0e2
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,99 @@
+package gcplog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var contextLabelRegistry = struct {
+	sync.RWMutex
+	keys map[string]interface{}
+}{keys: map[string]interface{}{}}
+
+// RegisterContextLabel registers key as a context key whose value, when
+// set, labels the entries logged with the ctx-aware methods as label, e.g.
+// RegisterContextLabel("tenant", tenantKey). Values other than strings are
+// formatted with fmt. Register the labels once, at startup.
+func RegisterContextLabel(label string, key interface{}) {
+	contextLabelRegistry.Lock()
+	defer contextLabelRegistry.Unlock()
+	contextLabelRegistry.keys[label] = key
+}
+
+// contextLabels returns the registered labels set in ctx, or nil.
+func contextLabels(ctx context.Context) map[string]string {
+	contextLabelRegistry.RLock()
+	defer contextLabelRegistry.RUnlock()
+	var labels map[string]string
+	for label, key := range contextLabelRegistry.keys {
+		v := ctx.Value(key)
+		if v == nil {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		if s, ok := v.(string); ok {
+			labels[label] = s
+		} else {
+			labels[label] = fmt.Sprint(v)
+		}
+	}
+	return labels
+}
+
+var highCardinalityRegex = regexp.MustCompile(`^(?i:[a-f\d]{8}-[a-f\d]{4}-[a-f\d]{4}-[a-f\d]{4}-[a-f\d]{12}|[a-f\d]{16,})$`)
+
+// cardinalityGuard tracks the distinct values of the label keys, see
+// GcpLogOptions.LabelCardinalityLimit.
+type cardinalityGuard struct {
+	mu     sync.Mutex
+	since  time.Time
+	values map[string]map[string]struct{}
+	warned map[string]bool
+}
+
+func newCardinalityGuard() *cardinalityGuard {
+	return &cardinalityGuard{
+		values: map[string]map[string]struct{}{},
+		warned: map[string]bool{},
+	}
+}
+
+func (c *cardinalityGuard) check(labels map[string]string, limit int, window time.Duration) {
+	if window <= 0 {
+		window = time.Minute
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); now.Sub(c.since) > window {
+		c.since = now
+		c.values = map[string]map[string]struct{}{}
+	}
+	for key, value := range labels {
+		if c.warned[key] {
+			continue
+		}
+		if highCardinalityRegex.MatchString(value) {
+			c.warned[key] = true
+			log.Printf("Label %q looks high-cardinality: value %q looks like an id", key, value)
+			continue
+		}
+		values, ok := c.values[key]
+		if !ok {
+			values = map[string]struct{}{}
+			c.values[key] = values
+		}
+		values[value] = struct{}{}
+		if len(values) > limit {
+			c.warned[key] = true
+			delete(c.values, key)
+			log.Printf("Label %q looks high-cardinality: more than %d distinct values within %v", key, limit, window)
+		}
+	}
+}
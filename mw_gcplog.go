@@ -2,9 +2,13 @@ package gcplog
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
 	"net/http"
+	"os"
+	"runtime/debug"
 	"time"
+
+	"cloud.google.com/go/logging"
 )
 
 // responseWriter is a minimal wrapper for http.responseWriter that allows the
@@ -13,12 +17,14 @@ type responseWriter struct {
 	http.ResponseWriter
 	status      int
 	size        int
-	body        *bytes.Buffer
+	request     *RequestLog
 	wroteHeader bool
+	// labels are the ResponseLabelHeaders, captured with the header.
+	labels map[string]string
 }
 
-func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{ResponseWriter: w, body: &bytes.Buffer{}}
+func wrapResponseWriter(w http.ResponseWriter, request *RequestLog) *responseWriter {
+	return &responseWriter{ResponseWriter: w, request: request}
 }
 
 func (rw *responseWriter) Status() int {
@@ -30,7 +36,10 @@ func (rw *responseWriter) Size() int {
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body.Write(b)
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.request.CaptureBody(rw.Header(), b)
 	return rw.ResponseWriter.Write(b)
 }
 
@@ -39,6 +48,7 @@ func (rw *responseWriter) WriteHeader(code int) {
 		return
 	}
 	rw.status = code
+	rw.labels = rw.request.ResponseLabels(rw.Header())
 
 	var buf bytes.Buffer
 	rw.Header().Write(&buf)
@@ -49,10 +59,130 @@ func (rw *responseWriter) WriteHeader(code int) {
 
 }
 
+func defaultSeverity(r *http.Request, status int) logging.Severity {
+	if status < 400 {
+		return logging.Info
+	} else if status < 500 {
+		return logging.Warning
+	}
+	return logging.Error
+}
+
+// severity returns the severity of the entry of a completed request: the one
+// declared by its error, if not Default, else the one of its status and
+// latency. Either way NonErrorStatuses caps it at Warning.
+func (g *GcpLog) severity(r *http.Request, responseMeta *ResponseMetadata, declared logging.Severity) logging.Severity {
+	var severity logging.Severity
+	if g.options().SeverityFunc != nil {
+		severity = g.options().SeverityFunc(r, responseMeta.Status)
+	} else {
+		severity = defaultSeverity(r, responseMeta.Status)
+	}
+	if g.isSlow(responseMeta) && severity < logging.Warning {
+		severity = logging.Warning
+	}
+	if declared != logging.Default {
+		severity = declared
+	}
+	if g.isNonErrorStatus(responseMeta.Status) && severity > logging.Warning {
+		severity = logging.Warning
+	}
+	return severity
+}
+
+func (g *GcpLog) isNonErrorStatus(status int) bool {
+	for _, s := range g.options().NonErrorStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GcpLog) isSlow(responseMeta *ResponseMetadata) bool {
+	return g.options().SlowRequestThreshold > 0 && responseMeta.Latency > g.options().SlowRequestThreshold
+}
+
+// logResponse writes the entry of a completed request. From Warning up the
+// entry carries err, when the request failed, which is also reported as the
+// Warn and Error methods do. The entry ending the request flushes the entries
+// batched during the request at once.
+func (g *GcpLog) logResponse(severity logging.Severity, log string, err error, r *http.Request, responseMeta *ResponseMetadata) {
+	failed := severity >= logging.Warning && err != nil
+
+	var payload interface{} = log
+	if failed {
+		payload = errorPayload(err)
+	}
+	if g.options().StructuredRequestLog {
+		payload = g.requestPayload(r, responseMeta, payload)
+	}
+	go func() {
+		g.log(payload, r, responseMeta, severity)
+		if g.endsOperation && isBatched(r) {
+			g.FlushLogs()
+		}
+	}()
+
+	duplicate := g.endsOperation && g.options().SuppressDuplicateReports && isReported(r)
+	nonError := g.isNonErrorStatus(responseMeta.Status)
+	if failed && !duplicate && !nonError && os.Getenv("GO_ENV") == "production" {
+		g.errAsync(err, r, debug.Stack())
+	}
+}
+
+// requestPayload is the structured payload of a completed request, merging
+// message: the log line, or the payload of the error of a failed request.
+func (g *GcpLog) requestPayload(r *http.Request, responseMeta *ResponseMetadata, message interface{}) map[string]interface{} {
+	payload := map[string]interface{}{
+		"method":     r.Method,
+		"path":       g.loggedRequest(r).URL.Path,
+		"status":     responseMeta.Status,
+		"user_agent": r.UserAgent(),
+	}
+	for k, v := range g.latencyFields(responseMeta.Latency) {
+		payload[k] = v
+	}
+	if user := g.extractUser(r); user != "" {
+		payload["user"] = user
+	}
+	if id := RequestID(r); id != "" {
+		payload["request_id"] = id
+	}
+	switch message := message.(type) {
+	case map[string]interface{}:
+		for k, v := range message {
+			payload[k] = v
+		}
+	default:
+		payload["message"] = message
+	}
+	return payload
+}
+
+// latencyFields are the fields of latency in structured payloads, a
+// readable "latency" string and a numeric "latency_ms" by default.
+func (g *GcpLog) latencyFields(latency time.Duration) map[string]interface{} {
+	if g.options().LatencyFields != nil {
+		return g.options().LatencyFields(latency)
+	}
+	return map[string]interface{}{
+		"latency":    latency.Round(100 * time.Microsecond).String(),
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+	}
+}
+
 func defaultLogBuilder(r *http.Request) string {
-	log := r.Method + " " + r.URL.Path
-	if r.Header.Get("X-Request-ID") != "" {
-		log = "[" + r.Header.Get("X-Request-ID") + "] " + log
+	path := r.URL.Path
+	if pattern := routePattern(r); pattern != "" {
+		path = pattern
+	}
+	log := r.Method + " " + path
+	if r.URL.RawQuery != "" {
+		log += "?" + r.URL.RawQuery
+	}
+	if id := RequestID(r); id != "" {
+		log = "[" + id + "] " + log
 	}
 	return log
 }
@@ -60,44 +190,126 @@ func defaultLogBuilder(r *http.Request) string {
 func defaultErrorBuilder(r *http.Request, status int, size int, body *bytes.Buffer) error {
 	var err error
 	if body != nil {
-		err = fmt.Errorf(body.String())
+		err = errors.New(body.String())
 	} else {
-		err = fmt.Errorf(r.Method + " " + r.URL.Path)
+		err = errors.New(r.Method + " " + r.URL.Path)
 	}
 	return err
 }
 
+// Response describes the response of a failed request to an error builder.
+type Response struct {
+	Status int
+	Size   int
+	// Header is the header of the response, which may carry the error detail,
+	// e.g. an X-Error-Code header.
+	Header http.Header
+	// Body is the captured response body, nil if not captured.
+	Body *bytes.Buffer
+}
+
 type options struct {
 	logBuilder   func(r *http.Request) string
-	errorBuilder func(r *http.Request, status int, size int, body *bytes.Buffer) error
+	errorBuilder func(r *http.Request, response Response) error
+	// BufferBody captures the response body for the error builder, true by
+	// default. Turning it off saves duplicating every response body in
+	// memory when the error builder doesn't need it: Response.Body is then
+	// nil.
+	BufferBody bool
+	// extractUser overrides GcpLogOptions.ExtractUserFromRequest.
+	extractUser func(r *http.Request) string
 }
 
-func NewOptions(logBuilder func(r *http.Request) string, errorBuilder func(r *http.Request, status int, size int, body *bytes.Buffer) error) options {
-	options := options{}
+// Option configures the http middleware, see NewMiddlewareOptions.
+type Option func(*options)
 
-	if logBuilder != nil {
-		options.logBuilder = logBuilder
-	} else {
+// WithLogBuilder sets the builder of the log line of the requests.
+func WithLogBuilder(logBuilder func(r *http.Request) string) Option {
+	return func(o *options) {
+		o.logBuilder = logBuilder
+	}
+}
+
+// WithErrorBuilder sets the builder of the error of the failed requests. It
+// is given the request as logged, with its URL redacted and sanitized.
+func WithErrorBuilder(errorBuilder func(r *http.Request, response Response) error) Option {
+	return func(o *options) {
+		o.errorBuilder = errorBuilder
+	}
+}
+
+// WithUserExtractor sets how the user of the requests is read, instead of
+// GcpLogOptions.ExtractUserFromRequest.
+func WithUserExtractor(extractUser func(r *http.Request) string) Option {
+	return func(o *options) {
+		o.extractUser = extractUser
+	}
+}
+
+// WithBufferBody sets options.BufferBody.
+func WithBufferBody(bufferBody bool) Option {
+	return func(o *options) {
+		o.BufferBody = bufferBody
+	}
+}
+
+// NewMiddlewareOptions returns the options of MiddlewareCustom, the defaults
+// being overridden by opts, e.g.
+// NewMiddlewareOptions(WithLogBuilder(lb), WithBufferBody(false)).
+func NewMiddlewareOptions(opts ...Option) options {
+	options := options{
+		logBuilder:   defaultLogBuilder,
+		errorBuilder: defaultResponseErrorBuilder,
+		BufferBody:   true,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.logBuilder == nil {
 		options.logBuilder = defaultLogBuilder
 	}
+	if options.errorBuilder == nil {
+		options.errorBuilder = defaultResponseErrorBuilder
+	}
+	return options
+}
 
+// NewOptions returns the options of MiddlewareCustom with the given
+// builders, the defaults being used for nil ones.
+//
+// Deprecated: use NewMiddlewareOptions with WithLogBuilder and
+// WithErrorBuilder.
+func NewOptions(logBuilder func(r *http.Request) string, errorBuilder func(r *http.Request, status int, size int, body *bytes.Buffer) error) options {
+	var responseErrorBuilder func(r *http.Request, response Response) error
 	if errorBuilder != nil {
-		options.errorBuilder = errorBuilder
-	} else {
-		options.errorBuilder = defaultErrorBuilder
+		responseErrorBuilder = func(r *http.Request, response Response) error {
+			return errorBuilder(r, response.Status, response.Size, response.Body)
+		}
 	}
+	return NewMiddlewareOptions(WithLogBuilder(logBuilder), WithErrorBuilder(responseErrorBuilder))
+}
 
-	return options
+// NewResponseOptions is like NewOptions, with an error builder that also sees
+// the response headers.
+//
+// Deprecated: use NewMiddlewareOptions with WithLogBuilder and
+// WithErrorBuilder.
+func NewResponseOptions(logBuilder func(r *http.Request) string, errorBuilder func(r *http.Request, response Response) error) options {
+	return NewMiddlewareOptions(WithLogBuilder(logBuilder), WithErrorBuilder(errorBuilder))
+}
+
+func defaultResponseErrorBuilder(r *http.Request, response Response) error {
+	return defaultErrorBuilder(r, response.Status, response.Size, response.Body)
 }
 
 func Middleware(gcplog *GcpLog) func(http.Handler) http.Handler {
-	return middleware(
-		gcplog,
-		options{
-			logBuilder:   defaultLogBuilder,
-			errorBuilder: defaultErrorBuilder,
-		},
-	)
+	return middleware(gcplog, NewMiddlewareOptions())
+}
+
+// Wrap applies Middleware to a single handler, e.g.
+// http.ListenAndServe(":8080", gcplog.Wrap(logger, mux)).
+func Wrap(gcplog *GcpLog, h http.Handler) http.Handler {
+	return Middleware(gcplog)(h)
 }
 
 func MiddlewareCustom(
@@ -111,41 +323,60 @@ func middleware(
 	gcplog *GcpLog,
 	options options,
 ) func(http.Handler) http.Handler {
+	if gcplog == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	if options.extractUser != nil {
+		gcplog = gcplog.withUserExtractor(options.extractUser)
+	}
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 
-			defer func() {
-
-				if err := recover(); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					gcplog.ErrorR(err.(error), r)
-
-				}
-			}()
-
-			begin := time.Now()
-			wrapped := wrapResponseWriter(w)
-			next.ServeHTTP(wrapped, r)
-
-			// after request
-			status := wrapped.status
-			log := options.logBuilder(r)
-			err := options.errorBuilder(r, wrapped.status, wrapped.size, wrapped.body)
-			responseMeta := ResponseMetadata{
-				Size:    wrapped.Size(),
-				Status:  wrapped.Status(),
-				Latency: time.Since(begin),
+			request := gcplog.StartRequest(w, r, options.BufferBody)
+			r = request.Request()
+			wrapped := wrapResponseWriter(w, request)
+			// A request whose handler panicked still ends, as failed,
+			// flushing its batch and closing its operation.
+			status := http.StatusInternalServerError
+			if gcplog.serve(next, wrapped, r) {
+				status = wrapped.Status()
 			}
 
-			if status < 400 {
-				gcplog.LogRM(log, r, &responseMeta)
-			} else if status >= 400 && status < 500 {
-				gcplog.WarnRM(err, r, &responseMeta)
-			} else {
-				gcplog.ErrorRM(err, r, &responseMeta)
+			// after request
+			logged := gcplog.loggedRequest(r)
+			var err error
+			if status >= 400 {
+				err = options.errorBuilder(logged, Response{
+					Status: status,
+					Size:   wrapped.size,
+					Header: wrapped.Header(),
+					Body:   request.Body(),
+				})
 			}
+			request.End(r, RequestOutcome{
+				Status: status,
+				Size:   wrapped.Size(),
+				Log:    options.logBuilder(logged),
+				Err:    err,
+				Labels: wrapped.labels,
+			})
 		}
 
 		return http.HandlerFunc(fn)
 	}
 }
+
+// serve calls next, reporting whether it returned: a panic is recovered with
+// a 500 response, unless the header is already written.
+func (g *GcpLog) serve(next http.Handler, w *responseWriter, r *http.Request) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.recovered(v, r)
+		}
+	}()
+	next.ServeHTTP(w, r)
+	return true
+}
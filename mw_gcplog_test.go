@@ -0,0 +1,121 @@
+package gcplog_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestFailedRequestErrorUsesLoggedPath(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions: server.ClientOptions(),
+		SanitizeURL: func(u *url.URL) string {
+			return "/users/:ssn"
+		},
+	})
+
+	middleware := gcplog.MiddlewareCustom(&g, gcplog.NewMiddlewareOptions(gcplog.WithBufferBody(false)))
+	h := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/123-45-6789", nil))
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	g.Close()
+	for _, e := range entries {
+		if payload := fmt.Sprint(e.Payload); strings.Contains(payload, "123-45-6789") {
+			t.Errorf("entry %q leaks the raw path", payload)
+		}
+	}
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool {
+		return strings.Contains(fmt.Sprint(e.Payload), "GET /users/:ssn")
+	})
+}
+
+func TestFailedRequestErrorKeepsPercentVerbs(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions: server.ClientOptions(),
+	})
+
+	h := gcplog.Middleware(&g)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("quota at 100%d"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	server.WaitForEntries(t, 1, 5*time.Second)
+	g.Close()
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool {
+		return strings.Contains(fmt.Sprint(e.Payload), "quota at 100%d")
+	})
+}
+
+func TestMiddlewareWithoutLogger(t *testing.T) {
+	h := gcplog.Middleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("got %d %q, want the handler response", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMiddlewareRecoversPanic(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:        server.ClientOptions(),
+		BufferDelayThreshold: time.Minute,
+	})
+	defer g.Close()
+
+	h := gcplog.Wrap(&g, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.LogR("before", r)
+		// LogR is asynchronous: let the entry reach the batch first.
+		time.Sleep(50 * time.Millisecond)
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want 500", rec.Code)
+	}
+
+	// The request ends: its batch is flushed and its operation closed.
+	entries := server.WaitForEntries(t, 3, 5*time.Second)
+	last := 0
+	for _, e := range entries {
+		if e.Operation != nil && e.Operation.Last {
+			last++
+			if e.HTTPRequest.GetStatus() != http.StatusInternalServerError {
+				t.Errorf("last entry has status %d, want 500", e.HTTPRequest.GetStatus())
+			}
+		}
+	}
+	if last != 1 {
+		t.Errorf("got %d last entries, want 1", last)
+	}
+
+	// The panic is reported once, with the request.
+	reports := server.WaitForErrors(t, 1, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if reports = server.Errors(); len(reports) != 1 || !strings.Contains(reports[0].Message, "panic: boom") {
+		t.Errorf("reports = %+v, want the panic once", reports)
+	}
+}
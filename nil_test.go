@@ -0,0 +1,139 @@
+package gcplog_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// TestNilLogger calls every method on a nil *GcpLog, which must all be
+// no-ops so that optional logging can be expressed with a nil pointer.
+func TestNilLogger(t *testing.T) {
+	var g *gcplog.GcpLog
+	ctx := context.Background()
+	err := errors.New("boom")
+	r := httptest.NewRequest("GET", "/", nil)
+	meta := &gcplog.ResponseMetadata{Status: http.StatusOK}
+
+	g.Reconfigure(gcplog.GcpLogOptions{})
+	g.Log("log")
+	g.LogR("log", r)
+	g.LogRM("log", r, meta)
+	g.At(gcplog.Notice, "log")
+	g.AtR(gcplog.Notice, "log", r)
+	g.AtRM(gcplog.Notice, "log", r, meta)
+	g.LogBatch([]interface{}{"a", "b"})
+	g.LogTo("audit", "log", gcplog.Info)
+	g.LogWithTrace("0123456789abcdef0123456789abcdef", "log")
+	g.LogProto(wrapperspb.String("log"), gcplog.Info)
+	g.Debug("log")
+	g.DebugR("log", r)
+	g.DebugCtx(ctx, "log")
+	g.LogCtx(ctx, "log")
+	g.Warn(err)
+	g.WarnR(err, r)
+	g.WarnRM(err, r, meta)
+	g.WarnCtx(ctx, err)
+	g.Error(err)
+	g.ErrorR(err, r)
+	g.ErrorRM(err, r, meta)
+	g.ErrorCtx(ctx, err)
+	g.LogSync("log")
+	g.ErrorSync(err)
+	fmt.Fprintln(g.Writer(gcplog.Info), "log")
+
+	if got := g.ErrorReturn(err); got != err {
+		t.Errorf("ErrorReturn = %v, want %v", got, err)
+	}
+	if got := g.ErrorReturnR(err, r); got != err {
+		t.Errorf("ErrorReturnR = %v, want %v", got, err)
+	}
+	if got := g.WarnReturn(err); got != err {
+		t.Errorf("WarnReturn = %v, want %v", got, err)
+	}
+	if got := g.WarnReturnR(err, r); got != err {
+		t.Errorf("WarnReturnR = %v, want %v", got, err)
+	}
+
+	for name, derived := range map[string]*gcplog.GcpLog{
+		"Named":         g.Named("component"),
+		"WithLabels":    g.WithLabels(map[string]string{"k": "v"}),
+		"InProject":     g.InProject("other"),
+		"Timestamped":   g.Timestamped(time.Now()),
+		"PubSubMessage": g.PubSubMessage("id", time.Now()),
+	} {
+		if derived != nil {
+			t.Errorf("%s = %v, want nil", name, derived)
+		}
+	}
+
+	counting := g.CountingLogger(time.Minute, nil)
+	counting.Count("log")
+	counting.Flush()
+	counting.Stop()
+
+	request := g.StartRequest(httptest.NewRecorder(), r, true)
+	request.CaptureBody(http.Header{}, []byte("body"))
+	request.End(request.Request(), gcplog.RequestOutcome{Status: http.StatusInternalServerError, Err: err})
+
+	// The panic is swallowed, as by a non-nil logger.
+	func() {
+		defer gcplog.Recover(g)()
+		panic("nil logger")
+	}()
+	gcplog.DrainOnSignal(g, time.Second)()
+
+	if severity := g.SeverityOf(err); severity != gcplog.Error {
+		t.Errorf("SeverityOf = %v, want Error", severity)
+	}
+	if n := g.DroppedErrorReports(); n != 0 {
+		t.Errorf("DroppedErrorReports = %d, want 0", n)
+	}
+	g.FlushErrors()
+	if err := g.FlushLogs(); err != nil {
+		t.Errorf("FlushLogs = %v", err)
+	}
+	if err := g.Flush(ctx); err != nil {
+		t.Errorf("Flush = %v", err)
+	}
+	g.Ping(ctx)
+	g.Close()
+}
+
+func TestNilLoggerMiddlewares(t *testing.T) {
+	var g *gcplog.GcpLog
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	client := &http.Client{Transport: gcplog.Transport(http.DefaultTransport, g)}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Transport: %v", err)
+	}
+	resp.Body.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	middlewares := map[string]http.Handler{
+		"Middleware": gcplog.Middleware(g)(handler),
+		"Wrap":       gcplog.Wrap(g, handler),
+		"MiddlewareCustom": gcplog.MiddlewareCustom(g, gcplog.NewMiddlewareOptions(
+			gcplog.WithUserExtractor(func(r *http.Request) string { return "user" }),
+		))(handler),
+	}
+	for name, h := range middlewares {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package gcplog
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+const operationProducer = "github.com/ftognetto/gcplog"
+
+// operation groups the entries of a request handled by the middlewares, so
+// that Cloud Logging collapses them into one expandable group.
+type operation struct {
+	id      string
+	started int32
+}
+
+// withOperation starts the operation of r, identified by its trace id, or
+// else its request id or a generated one.
+func (g *GcpLog) withOperation(r *http.Request) *http.Request {
+	id := r.Header.Get(traceHeader)
+	if i := strings.IndexAny(id, "/;"); i >= 0 {
+		id = id[:i]
+	}
+	if id == "" {
+		id = RequestID(r)
+	}
+	if id == "" {
+		id = g.newID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), operationKey, &operation{id: id}))
+}
+
+// entryOperation returns the operation of an entry logged with request: the
+// first one is marked First, the one ending the request Last.
+func entryOperation(request *http.Request, last bool) *logpb.LogEntryOperation {
+	if request == nil {
+		return nil
+	}
+	op, ok := request.Context().Value(operationKey).(*operation)
+	if !ok {
+		return nil
+	}
+	return &logpb.LogEntryOperation{
+		Id:       op.id,
+		Producer: operationProducer,
+		First:    atomic.CompareAndSwapInt32(&op.started, 0, 1),
+		Last:     last,
+	}
+}
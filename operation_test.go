@@ -0,0 +1,59 @@
+package gcplog_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestRequestOperation(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+	defer g.Close()
+
+	h := gcplog.Wrap(&g, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.LogR("first", r)
+		// LogR is asynchronous: keep the entries in order.
+		time.Sleep(50 * time.Millisecond)
+		g.LogR("second", r)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := server.WaitForEntries(t, 3, 5*time.Second)
+	byPayload := map[interface{}]gcplogtest.Entry{}
+	for _, e := range entries {
+		if e.Operation == nil {
+			t.Fatalf("entry %v has no operation", e.Payload)
+		}
+		if e.Operation.Id != "105445aa7843bc8bf206b12000100000" {
+			t.Errorf("entry %v has operation id %q, want the trace id", e.Payload, e.Operation.Id)
+		}
+		byPayload[e.Payload] = e
+	}
+	tests := []struct {
+		payload     string
+		first, last bool
+	}{
+		{"first", true, false},
+		{"second", false, false},
+		{"GET /", false, true},
+	}
+	for _, tt := range tests {
+		op := byPayload[tt.payload].Operation
+		if op == nil {
+			t.Errorf("no entry %q", tt.payload)
+			continue
+		}
+		if op.First != tt.first || op.Last != tt.last {
+			t.Errorf("entry %q: first = %v, last = %v, want %v, %v", tt.payload, op.First, op.Last, tt.first, tt.last)
+		}
+	}
+}
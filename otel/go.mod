@@ -0,0 +1,15 @@
+module github.com/ftognetto/gcplog/otel
+
+go 1.16
+
+require (
+	cloud.google.com/go/logging v1.4.2
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/ftognetto/gcplog v1.0.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+)
+
+// Local development against the root module in this repository; ignored by
+// consumers, who get the required release.
+replace github.com/ftognetto/gcplog => ../
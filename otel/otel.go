@@ -0,0 +1,69 @@
+// Package otel correlates gcplog entries with OpenTelemetry spans. It is a
+// module of its own so that gcplog doesn't depend on OpenTelemetry.
+//
+// Errors logged through this package are also recorded as an event on the
+// span active in the given context, and the span status is set to Error, so
+// Cloud Logging entries and Cloud Trace spans point at each other. Set
+// SpanContext as gcplog.GcpLogOptions.SpanContext for the entries logged with
+// the ctx-aware methods to carry the id of the active span.
+package otel
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/logging"
+	"github.com/ftognetto/gcplog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error logs err with g and records it on the span active in ctx, at the
+// severity given by gcplog.GcpLogOptions.ClassifyError: the span status is
+// set to Error from Error up.
+func Error(ctx context.Context, g *gcplog.GcpLog, err error) {
+	g.Error(err)
+	recordError(ctx, err, g.SeverityOf(err))
+}
+
+// ErrorR logs err with g and records it as Error does on the span active in
+// the request context, if any.
+func ErrorR(g *gcplog.GcpLog, err error, request *http.Request) {
+	g.ErrorR(err, request)
+	if request == nil {
+		return
+	}
+	recordError(request.Context(), err, g.SeverityOf(err))
+}
+
+// Warn logs err with g and records it as an event on the span active in ctx,
+// without changing the span status.
+func Warn(ctx context.Context, g *gcplog.GcpLog, err error) {
+	g.Warn(err)
+	recordError(ctx, err, logging.Warning)
+}
+
+// SpanContext reads the span active in ctx, to be set as
+// gcplog.GcpLogOptions.SpanContext so that the entries logged with the
+// ctx-aware methods link to the exact span in Cloud Trace.
+func SpanContext(ctx context.Context) (traceID, spanID string, sampled bool) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return "", "", false
+	}
+	return spanContext.TraceID().String(), spanContext.SpanID().String(), spanContext.IsSampled()
+}
+
+func recordError(ctx context.Context, err error, severity logging.Severity) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.RecordError(err, trace.WithAttributes(
+		attribute.String("gcplog.severity", severity.String()),
+	))
+	if severity >= logging.Error {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
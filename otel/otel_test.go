@@ -0,0 +1,60 @@
+package otel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+	gcplogotel "github.com/ftognetto/gcplog/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingSpan records the calls of gcplogotel on a span.
+type recordingSpan struct {
+	trace.Span
+	errors int
+	status codes.Code
+}
+
+func (s *recordingSpan) IsRecording() bool { return true }
+
+func (s *recordingSpan) RecordError(err error, options ...trace.EventOption) { s.errors++ }
+
+func (s *recordingSpan) SetStatus(code codes.Code, description string) { s.status = code }
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name       string
+		severity   gcplog.Severity
+		wantStatus codes.Code
+	}{
+		{"error", gcplog.Error, codes.Error},
+		{"downgraded", gcplog.Warning, codes.Unset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gcplogtest.NewServer()
+			defer server.Close()
+			g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+				ClientOptions: server.ClientOptions(),
+				ClassifyError: func(error) gcplog.Severity { return tt.severity },
+			})
+			defer g.Close()
+
+			span := &recordingSpan{Span: trace.SpanFromContext(context.Background())}
+			ctx := trace.ContextWithSpan(context.Background(), span)
+			gcplogotel.Error(ctx, &g, errors.New("boom"))
+
+			if span.errors != 1 || span.status != tt.wantStatus {
+				t.Errorf("span got %d errors and status %v, want 1 and %v", span.errors, span.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestErrorRWithoutRequest(t *testing.T) {
+	gcplogotel.ErrorR(nil, errors.New("boom"), nil)
+}
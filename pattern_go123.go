@@ -0,0 +1,19 @@
+//go:build go1.23
+// +build go1.23
+
+package gcplog
+
+import (
+	"net/http"
+	"strings"
+)
+
+// routePattern returns the http.ServeMux pattern that matched r, without the
+// method, or "" if r wasn't routed by a pattern.
+func routePattern(r *http.Request) string {
+	pattern := r.Pattern
+	if i := strings.Index(pattern, " "); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i+1:], " ")
+	}
+	return pattern
+}
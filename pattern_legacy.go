@@ -0,0 +1,11 @@
+//go:build !go1.23
+// +build !go1.23
+
+package gcplog
+
+import "net/http"
+
+// routePattern returns "": http.Request.Pattern requires Go 1.23.
+func routePattern(r *http.Request) string {
+	return ""
+}
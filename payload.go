@@ -0,0 +1,215 @@
+package gcplog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"cloud.google.com/go/logging"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// toPayload normalizes a payload before it is set on a logging.Entry, with
+// GcpLogOptions.EncodePayload if set.
+//
+// Proto messages are converted with protojson, so they end up as a
+// well-formed jsonPayload using the proto field names rather than the
+// encoding of the generated Go struct. Payloads that would not survive the
+// JSON encoding, such as channels or structs with only unexported fields,
+// and payloads that don't encode to an object, such as numbers or slices,
+// are formatted as text instead of disappearing.
+func (g *GcpLog) toPayload(payload interface{}) interface{} {
+	if g.options().EncodePayload != nil {
+		payload = g.options().EncodePayload(payload)
+	}
+	if m, ok := payload.(map[string]interface{}); ok {
+		payload = g.withMessageKey(m)
+	}
+	if msg, ok := payload.(proto.Message); ok {
+		b, err := protojson.Marshal(msg)
+		if err != nil {
+			return payload
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return payload
+		}
+		return json.RawMessage(b)
+	}
+	switch payload.(type) {
+	case nil, string:
+		return payload
+	}
+	// The encoding is kept for the logging client and truncate, which
+	// would otherwise encode the payload again.
+	b, ok := encodeObject(payload)
+	if !ok {
+		return fmt.Sprintf("%+v", payload)
+	}
+	return json.RawMessage(b)
+}
+
+// truncate cuts the payload of entry down to MaxPayloadSize, as text,
+// returning its original size if it was over.
+func (g *GcpLog) truncate(entry *logging.Entry) int {
+	max := g.options().MaxPayloadSize
+	if max == 0 {
+		max = DefaultMaxPayloadSize
+	}
+	if max < 0 {
+		return 0
+	}
+	var b []byte
+	switch payload := entry.Payload.(type) {
+	case string:
+		b = []byte(payload)
+	case json.RawMessage:
+		b = payload
+	default:
+		var err error
+		if b, err = json.Marshal(payload); err != nil {
+			return 0
+		}
+	}
+	if len(b) <= max {
+		return 0
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	entry.Payload = string(b[:cut]) + "…"
+	return len(b)
+}
+
+// withMessageKey returns payload with its "message" field renamed to
+// MessageKey, if set.
+func (g *GcpLog) withMessageKey(payload map[string]interface{}) map[string]interface{} {
+	key := g.options().MessageKey
+	message, ok := payload["message"]
+	if key == "" || key == "message" || !ok {
+		return payload
+	}
+	if _, ok := payload[key]; ok {
+		return payload
+	}
+	renamed := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		renamed[k] = v
+	}
+	delete(renamed, "message")
+	renamed[key] = message
+	return renamed
+}
+
+// encodeObject returns the encoding of payload if it is a JSON object
+// keeping the content of payload: a jsonPayload can't hold a number or an
+// array. An empty object is kept, e.g. a struct whose fields are all
+// omitempty, unless payload is a struct with only unexported fields, which
+// encodes to one whatever its content.
+func encodeObject(payload interface{}) ([]byte, bool) {
+	b, err := json.Marshal(payload)
+	if err != nil || len(b) == 0 || b[0] != '{' {
+		return nil, false
+	}
+	if string(b) == "{}" && hidesFields(reflect.Indirect(reflect.ValueOf(payload))) {
+		return nil, false
+	}
+	return b, true
+}
+
+// hidesFields reports whether v is a struct with fields, none of which is
+// encoded to JSON.
+func hidesFields(v reflect.Value) bool {
+	if v.Kind() != reflect.Struct || v.NumField() == 0 {
+		return false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" || f.Anonymous {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrorCoder is implemented by errors carrying an application error code.
+type ErrorCoder interface {
+	Code() string
+}
+
+// Payloader is implemented by errors carrying a structured payload, such as
+// ValidationError. They are logged with that payload instead of their
+// message, e.g. when returned by a middleware error builder.
+type Payloader interface {
+	Payload() map[string]interface{}
+}
+
+// ValidationError is a Payloader for requests rejected with per-field
+// errors, logged as {"message": ..., "fields": {...}}.
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Payload() map[string]interface{} {
+	return map[string]interface{}{
+		"message": e.Message,
+		"fields":  e.Fields,
+	}
+}
+
+// errorPayload builds the payload of the error-logging path. Errors
+// implementing Payloader are logged with their payload, and the ones
+// implementing ErrorCoder as a structured payload so entries are queryable by
+// jsonPayload.error.type and jsonPayload.error.code. Wrapped errors include
+// the messages of their whole chain; other errors are logged as a plain
+// string.
+func errorPayload(err error) interface{} {
+	var payloader Payloader
+	if errors.As(err, &payloader) {
+		// The map of Payload may be shared: it is copied, not modified.
+		fields := payloader.Payload()
+		payload := make(map[string]interface{}, len(fields)+1)
+		for k, v := range fields {
+			payload[k] = v
+		}
+		if _, ok := payload["message"]; !ok {
+			payload["message"] = err.Error()
+		}
+		return payload
+	}
+
+	chain := errorChain(err)
+
+	var coder ErrorCoder
+	if !errors.As(err, &coder) {
+		if len(chain) == 1 {
+			return err.Error()
+		}
+		return map[string]interface{}{
+			"message": err.Error(),
+			"chain":   chainMessages(chain),
+		}
+	}
+	payload := map[string]interface{}{
+		"message": err.Error(),
+		"error": map[string]interface{}{
+			"message": err.Error(),
+			"type":    reflect.TypeOf(coder).String(),
+			"code":    coder.Code(),
+		},
+	}
+	if len(chain) > 1 {
+		payload["chain"] = chainMessages(chain)
+	}
+	return payload
+}
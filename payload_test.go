@@ -0,0 +1,70 @@
+package gcplog_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+)
+
+func TestPayloadEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload interface{}
+		want    interface{}
+	}{
+		{"string", "hello", "hello"},
+		{"map", map[string]interface{}{"a": "b"}, map[string]interface{}{"a": "b"}},
+		{"struct", struct{ A string }{"b"}, map[string]interface{}{"A": "b"}},
+		{"number", 42, "42"},
+		{"slice", []string{"a", "b"}, "[a b]"},
+		{"unexported fields", struct{ a string }{"b"}, "{a:b}"},
+		{"empty struct", struct {
+			A string `json:"a,omitempty"`
+		}{}, map[string]interface{}{}},
+		{"channel", make(chan int), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gcplogtest.NewServer()
+			defer server.Close()
+			g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+			defer g.Close()
+
+			g.Log(tt.payload)
+
+			entries := server.WaitForEntries(t, 1, 5*time.Second)
+			if tt.want == nil {
+				if _, ok := entries[0].Payload.(string); !ok {
+					t.Errorf("payload = %#v, want text", entries[0].Payload)
+				}
+				return
+			}
+			if !reflect.DeepEqual(entries[0].Payload, tt.want) {
+				t.Errorf("payload = %#v, want %#v", entries[0].Payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtoPayload(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+	defer g.Close()
+
+	g.Log(&logtypepb.HttpRequest{RequestMethod: "GET", Status: 200})
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	payload, ok := entries[0].Payload.(map[string]interface{})
+	if !ok {
+		t.Fatalf("payload = %#v, want a jsonPayload", entries[0].Payload)
+	}
+	want := map[string]interface{}{"requestMethod": "GET", "status": float64(200)}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("payload = %#v, want the protojson encoding %#v", payload, want)
+	}
+}
@@ -0,0 +1,104 @@
+package gcplog
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/logging"
+)
+
+// projectLoggers are the loggers of the other projects written to, see
+// InProject, with their clients created on first use.
+type projectLoggers struct {
+	mu      sync.Mutex
+	clients map[string]*logging.Client
+	loggers map[string]*logging.Logger
+}
+
+func newProjectLoggers() *projectLoggers {
+	return &projectLoggers{
+		clients: map[string]*logging.Client{},
+		loggers: map[string]*logging.Logger{},
+	}
+}
+
+// InProject returns a logger writing its entries to the log of the service
+// in the project projectId rather than in the project of g, e.g. to route
+// some entries to a central logging project. The client of the project is
+// created on first use, shared by the loggers of g and closed by Close.
+// Errors are still reported to the project of g. If the client can't be
+// created, the failure is passed to OnError and g is returned.
+func (g *GcpLog) InProject(projectId string) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	if projectId == g.projectId {
+		return g
+	}
+	logger, err := g.projects.logger(projectId, g.logID(), g.config)
+	if err != nil {
+		handleError(g.options(), "Could not create logging client", err)
+		return g
+	}
+	in := *g
+	in.logger = logger
+	in.logName = logName(projectId, g.logID())
+	return &in
+}
+
+func (p *projectLoggers) logger(projectId string, logID string, config *config) (*logging.Logger, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := projectId + "/" + logID
+	if logger, ok := p.loggers[key]; ok {
+		return logger, nil
+	}
+	client, ok := p.clients[projectId]
+	if !ok {
+		var err error
+		client, err = logging.NewClient(context.Background(), projectId, config.load().ClientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		client.OnError = func(err error) {
+			handleError(config.load(), "Could not write log", err)
+		}
+		p.clients[projectId] = client
+	}
+	logger := client.Logger(logID, loggerOptions(config.load())...)
+	p.loggers[key] = logger
+	return logger, nil
+}
+
+// flush flushes the loggers of the other projects.
+func (p *projectLoggers) flush() error {
+	p.mu.Lock()
+	loggers := make([]*logging.Logger, 0, len(p.loggers))
+	for _, logger := range p.loggers {
+		loggers = append(loggers, logger)
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, logger := range loggers {
+		if flushErr := logger.Flush(); flushErr != nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// close closes the clients of the other projects, flushing their loggers.
+func (p *projectLoggers) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for _, client := range p.clients {
+		if closeErr := client.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
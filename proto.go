@@ -0,0 +1,155 @@
+package gcplog
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	vkit "cloud.google.com/go/logging/apiv2"
+	"google.golang.org/api/option"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// protoWriter writes protoPayload entries, which the logging client doesn't
+// support, with the underlying API client, dialed on first use along with the
+// detection of the monitored resource.
+type protoWriter struct {
+	projectId     string
+	clientOptions []option.ClientOption
+
+	once     sync.Once
+	client   *vkit.Client
+	resource *mrpb.MonitoredResource
+	err      error
+}
+
+func newProtoWriter(projectId string, clientOptions []option.ClientOption) *protoWriter {
+	return &protoWriter{
+		projectId:     projectId,
+		clientOptions: clientOptions,
+	}
+}
+
+func (w *protoWriter) write(ctx context.Context, logName string, entry *logpb.LogEntry) error {
+	w.once.Do(func() {
+		w.resource = detectResource(w.projectId)
+		w.client, w.err = vkit.NewClient(context.Background(), w.clientOptions...)
+	})
+	if w.err != nil {
+		return w.err
+	}
+	_, err := w.client.WriteLogEntries(ctx, &logpb.WriteLogEntriesRequest{
+		LogName:  logName,
+		Resource: w.resource,
+		Entries:  []*logpb.LogEntry{entry},
+	})
+	return err
+}
+
+func (w *protoWriter) close() error {
+	w.once.Do(func() {})
+	if w.client == nil {
+		return nil
+	}
+	return w.client.Close()
+}
+
+// LogProto writes msg at severity as the protoPayload of an entry, e.g. a
+// google.cloud.audit.AuditLog for sinks expecting audit logs, to the service
+// log, or to the log of g when derived by Named or InProject. Unlike the other
+// methods, the entry is written right away, outside of the batches of the
+// logging client, under the resource detected as the logging client does.
+func (g *GcpLog) LogProto(msg proto.Message, severity Severity) {
+	if g == nil {
+		return
+	}
+	go func() {
+		if g.isClosed() || !g.enabled(severity, nil) {
+			return
+		}
+		payload, err := anypb.New(msg)
+		if err != nil {
+			handleError(g.options(), "Could not write log", err)
+			return
+		}
+		entry := &logpb.LogEntry{
+			Severity: logtypepb.LogSeverity(severity),
+			Payload:  &logpb.LogEntry_ProtoPayload{ProtoPayload: payload},
+			Labels:   nilIfEmpty(g.labels),
+		}
+		// Left unset, as by the logging client, the timestamp is the time
+		// of receipt.
+		if !g.timestamp.IsZero() {
+			entry.Timestamp = timestamppb.New(g.timestamp)
+		}
+		if err := g.protoWriter.write(context.Background(), g.logName, entry); err != nil {
+			handleError(g.options(), "Could not write log", err)
+		}
+	}()
+}
+
+// logName is the full name of the log logID of the project projectId.
+func logName(projectId string, logID string) string {
+	return "projects/" + projectId + "/logs/" + url.PathEscape(logID)
+}
+
+// detectResource is the monitored resource of the service, as detected by
+// the logging client: the Cloud Run revision or App Engine version it runs
+// on, else the global resource of projectId.
+func detectResource(projectId string) *mrpb.MonitoredResource {
+	global := &mrpb.MonitoredResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": projectId},
+	}
+	cloudRun := os.Getenv("K_SERVICE") != "" && os.Getenv("K_REVISION") != "" && os.Getenv("K_CONFIGURATION") != ""
+	if !cloudRun && !onAppEngine {
+		return global
+	}
+	detectedProject, err := metadata.ProjectID()
+	if err != nil {
+		return global
+	}
+	zone, err := metadata.Zone()
+	if err != nil {
+		return global
+	}
+	if cloudRun {
+		return &mrpb.MonitoredResource{
+			Type: "cloud_run_revision",
+			Labels: map[string]string{
+				"project_id":         detectedProject,
+				"location":           regionFromZone(zone),
+				"service_name":       os.Getenv("K_SERVICE"),
+				"revision_name":      os.Getenv("K_REVISION"),
+				"configuration_name": os.Getenv("K_CONFIGURATION"),
+			},
+		}
+	}
+	return &mrpb.MonitoredResource{
+		Type: "gae_app",
+		Labels: map[string]string{
+			"project_id":  detectedProject,
+			"module_id":   os.Getenv("GAE_SERVICE"),
+			"version_id":  os.Getenv("GAE_VERSION"),
+			"instance_id": os.Getenv("GAE_INSTANCE"),
+			"runtime":     os.Getenv("GAE_RUNTIME"),
+			"zone":        zone,
+		},
+	}
+}
+
+// regionFromZone is the region of a zone such as "europe-west1-b".
+func regionFromZone(zone string) string {
+	if cutoff := strings.LastIndex(zone, "-"); cutoff > 0 {
+		return zone[:cutoff]
+	}
+	return zone
+}
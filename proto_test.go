@@ -0,0 +1,37 @@
+package gcplog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestLogProtoLogName(t *testing.T) {
+	tests := []struct {
+		name   string
+		logger func(g *gcplog.GcpLog) *gcplog.GcpLog
+		want   string
+	}{
+		{"service", func(g *gcplog.GcpLog) *gcplog.GcpLog { return g }, "projects/project/logs/service"},
+		{"named", func(g *gcplog.GcpLog) *gcplog.GcpLog { return g.Named("worker") }, "projects/project/logs/service.worker"},
+		{"in project", func(g *gcplog.GcpLog) *gcplog.GcpLog { return g.InProject("central") }, "projects/central/logs/service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gcplogtest.NewServer()
+			defer server.Close()
+			g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+			defer g.Close()
+
+			tt.logger(&g).LogProto(wrapperspb.String("audit"), gcplog.Notice)
+
+			entries := server.WaitForEntries(t, 1, 5*time.Second)
+			if entries[0].LogName != tt.want {
+				t.Errorf("log name = %q, want %q", entries[0].LogName, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package gcplog
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errorQueue bounds the error reports in flight, so that an error storm
+// doesn't spawn an unbounded number of goroutines calling Error Reporting.
+type errorQueue struct {
+	reports chan errorReport
+	dropped uint64
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+type errorReport struct {
+	gcplog  *GcpLog
+	err     error
+	request *http.Request
+	stack   []byte
+}
+
+func newErrorQueue(size int) *errorQueue {
+	q := &errorQueue{
+		reports: make(chan errorReport, size),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(q.done)
+		for {
+			select {
+			case report := <-q.reports:
+				report.gcplog.err(report.err, report.request, report.stack)
+			case <-q.quit:
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// close stops the worker and sends the reports still queued, within
+// DrainTimeout if set. The ones left are dropped, and OnError is told.
+func (q *errorQueue) close(options *GcpLogOptions) {
+	close(q.quit)
+	<-q.done
+
+	var deadline <-chan time.Time
+	if options.DrainTimeout > 0 {
+		deadline = time.After(options.DrainTimeout)
+	}
+	for {
+		select {
+		case <-deadline:
+			q.dropQueued(options)
+			return
+		default:
+		}
+		select {
+		case report := <-q.reports:
+			report.gcplog.err(report.err, report.request, report.stack)
+		default:
+			return
+		}
+	}
+}
+
+// dropQueued drops the reports still queued.
+func (q *errorQueue) dropQueued(options *GcpLogOptions) {
+	var n uint64
+	for {
+		select {
+		case <-q.reports:
+			n++
+		default:
+			if n > 0 {
+				dropped := atomic.AddUint64(&q.dropped, n)
+				handleError(options, "Could not log error", fmt.Errorf("%d error reports dropped, drain timed out (%d dropped so far)", n, dropped))
+			}
+			return
+		}
+	}
+}
+
+// errAsync reports err in the background, through the queue when
+// GcpLogOptions.ErrorQueueSize is set. Reports are dropped when the queue is
+// full, and OnError is told about it. stack is the stack of the caller, since
+// the report is made from another goroutine.
+func (g *GcpLog) errAsync(err error, request *http.Request, stack []byte) {
+	markReported(request)
+	if g.errorQueue == nil {
+		go g.err(err, request, stack)
+		return
+	}
+	select {
+	case g.errorQueue.reports <- errorReport{gcplog: g, err: err, request: request, stack: stack}:
+	default:
+		dropped := atomic.AddUint64(&g.errorQueue.dropped, 1)
+		handleError(g.options(), "Could not log error", fmt.Errorf("error report dropped, queue full (%d dropped so far): %v", dropped, err))
+	}
+}
+
+// DroppedErrorReports returns the number of error reports dropped because
+// the queue set by GcpLogOptions.ErrorQueueSize was full, or still queued
+// when Close timed out.
+func (g *GcpLog) DroppedErrorReports() uint64 {
+	if g == nil || g.errorQueue == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&g.errorQueue.dropped)
+}
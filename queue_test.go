@@ -0,0 +1,34 @@
+package gcplog_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestCloseDrainsErrorQueue(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:  server.ClientOptions(),
+		ErrorQueueSize: 10,
+	})
+
+	for i := 0; i < 5; i++ {
+		g.Error(errors.New("queued"))
+	}
+	g.Close()
+
+	if got := len(server.Errors()); got != 5 {
+		t.Errorf("got %d error reports after Close, want 5", got)
+	}
+	if dropped := g.DroppedErrorReports(); dropped != 0 {
+		t.Errorf("DroppedErrorReports = %d, want 0", dropped)
+	}
+}
@@ -0,0 +1,87 @@
+package gcplog
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+
+	"cloud.google.com/go/logging"
+)
+
+// Recover returns a function that, deferred in a goroutine, captures a panic
+// and reports it to Error Reporting with its stack:
+//
+//	go func() {
+//		defer gcplog.Recover(g)()
+//		...
+//	}()
+//
+// The panic is swallowed unless GcpLogOptions.Repanic is set, and with a nil
+// g, which reports nothing. The report is delivered before returning, since
+// the process may be about to crash.
+func Recover(g *GcpLog) func() {
+	return func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if g == nil {
+			return
+		}
+		stack := debug.Stack()
+		err := panicError(v, stack)
+		g.log(panicPayload(v, stack), nil, nil, logging.Critical)
+		if os.Getenv("GO_ENV") == "production" {
+			g.err(err, nil, stack)
+		}
+		if g.options().Repanic {
+			panic(v)
+		}
+	}
+}
+
+// recovered logs the panic v recovered while serving r, and records it as
+// the error of r, reported when the request ends.
+func (g *GcpLog) recovered(v interface{}, r *http.Request) {
+	if g == nil {
+		return
+	}
+	stack := debug.Stack()
+	// Logged before the request ends, which flushes its batch.
+	g.log(panicPayload(v, stack), r, nil, logging.Error)
+	SetError(r, panicError(v, stack))
+}
+
+// panicError converts a recovered value into an error, reported with the
+// stack of the panic rather than the one of the reporting goroutine.
+func panicError(v interface{}, stack []byte) error {
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("panic: %v", v)
+	}
+	if deepestStack(err) != nil {
+		return err
+	}
+	return &recoveredError{error: err, stack: stack}
+}
+
+type recoveredError struct {
+	error
+	stack []byte
+}
+
+func (e *recoveredError) Stack() []byte { return e.stack }
+
+func (e *recoveredError) Unwrap() error { return e.error }
+
+// panicPayload is the payload of the entry of a recovered panic, with the
+// type of the value to tell e.g. a nil map from a nil pointer dereference.
+func panicPayload(v interface{}, stack []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"message":     panicError(v, stack).Error(),
+		"panic_type":  fmt.Sprintf("%T", v),
+		"panic_value": fmt.Sprintf("%+v", v),
+		"stack":       string(normalizeStack(stack)),
+	}
+}
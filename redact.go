@@ -0,0 +1,108 @@
+package gcplog
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultRedactedQueryParams are always redacted from logged URLs, in
+// addition to GcpLogOptions.RedactQueryParams.
+var defaultRedactedQueryParams = []string{"token", "access_token", "password", "secret"}
+
+const redactedValue = "REDACTED"
+
+// redactQuery replaces the values of sensitive parameters in a raw query
+// string, keeping the original parameter order.
+func (g *GcpLog) redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key := param
+		if idx := strings.Index(param, "="); idx >= 0 {
+			key = param[:idx]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if g.isRedactedQueryParam(key) {
+			params[i] = url.QueryEscape(key) + "=" + redactedValue
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func (g *GcpLog) isRedactedQueryParam(key string) bool {
+	for _, name := range defaultRedactedQueryParams {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	for _, name := range g.options().RedactQueryParams {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedRequest returns r, or a shallow copy of it whose URL has the
+// sensitive query parameters redacted and GcpLogOptions.SanitizeURL applied,
+// and the scheme and host the client used when
+// GcpLogOptions.TrustForwardedHeaders is set. It is the request whose URL
+// ends up in entries and error reports.
+func (g *GcpLog) loggedRequest(r *http.Request) *http.Request {
+	if r.URL == nil {
+		return r
+	}
+	u := *r.URL
+	u.RawQuery = g.redactQuery(r.URL.RawQuery)
+	forwarded := g.options().TrustForwardedHeaders && g.forwardedURL(r, &u)
+	if g.options().SanitizeURL != nil {
+		sanitized, err := url.Parse(g.options().SanitizeURL(&u))
+		if err != nil {
+			sanitized = &url.URL{Path: redactedValue}
+		}
+		u = *sanitized
+	} else if u.RawQuery == r.URL.RawQuery && !forwarded {
+		return r
+	}
+	logged := r.WithContext(r.Context())
+	logged.URL = &u
+	return logged
+}
+
+// forwardedURL sets the scheme and host of u from the X-Forwarded-Proto and
+// X-Forwarded-Host headers set by load balancers, reporting whether any was
+// present.
+func (g *GcpLog) forwardedURL(r *http.Request, u *url.URL) bool {
+	proto := firstHeaderValue(r, "X-Forwarded-Proto")
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if proto == "" && host == "" {
+		return false
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	u.Scheme = proto
+	u.Host = host
+	return true
+}
+
+// firstHeaderValue returns the first of the comma-separated values of a
+// header, as appended by each proxy on the way.
+func firstHeaderValue(r *http.Request, name string) string {
+	value := r.Header.Get(name)
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,234 @@
+package gcplog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// RequestLog tracks a request handled by a middleware, so that integrations
+// with web frameworks (see the gin sub-package) log requests like Middleware
+// does. It is started by StartRequest before the handler runs and ended by
+// End once the response is written.
+type RequestLog struct {
+	gcplog   *GcpLog
+	request  *http.Request
+	begin    time.Time
+	sequence uint64
+	body     *bodyCapture
+	// requestBody is the captured request body, see CaptureRequestBody.
+	requestBody *requestBodyCapture
+}
+
+// RequestOutcome describes how a request tracked by a RequestLog ended.
+type RequestOutcome struct {
+	Status int
+	Size   int
+	// Route is the route template that matched the request, if any. It is
+	// logged instead of the concrete path, which is kept as the "path" label.
+	Route string
+	// Log overrides the log line of the request.
+	Log string
+	// Err is the error of a failed request (status >= 400). When nil, the
+	// error is built from the captured response body, if any.
+	Err error
+	// ClassifyErr tells that Err is an application error, whose severity,
+	// when GcpLogOptions.ClassifyError declares one, overrides the one of
+	// the status. The errors recorded with SetError always are.
+	ClassifyErr bool
+	// Labels are added to the entry of the request.
+	Labels map[string]string
+}
+
+// StartRequest starts tracking r, generating its id and stashing it in its
+// context as configured. The handler must be served with the request
+// returned by RequestLog.Request. When captureBody is set, the response body
+// written through CaptureBody is used to build the error of failed requests.
+func (g *GcpLog) StartRequest(w http.ResponseWriter, r *http.Request, captureBody bool) *RequestLog {
+	if g == nil {
+		return &RequestLog{request: r}
+	}
+	r = g.withRequestID(w, r)
+	r = withTraceHeader(r)
+	r = g.withBatching(r)
+	r = g.withOperation(r)
+	r = withReportedFlag(r)
+	r = withRecordedError(r)
+	r, requestBody := g.withRequestBodyCapture(r)
+	r = withRequest(r)
+
+	l := &RequestLog{
+		gcplog:      g,
+		request:     r,
+		sequence:    g.nextSequence(),
+		begin:       g.now(),
+		requestBody: requestBody,
+	}
+	if captureBody {
+		l.body = newBodyCapture(g)
+	}
+	if g.options().DebugTrace {
+		go g.logTraceDecision(r)
+	}
+	return l
+}
+
+// Request returns the request to serve the handler with.
+func (l *RequestLog) Request() *http.Request {
+	return l.request
+}
+
+// CaptureBody records b, written to a response with the given header.
+func (l *RequestLog) CaptureBody(header http.Header, b []byte) {
+	if l.body != nil {
+		l.body.write(header, b)
+	}
+}
+
+// ResponseLabels returns the labels of the ResponseLabelHeaders of header,
+// or nil, for the middlewares to add to RequestOutcome.Labels.
+func (l *RequestLog) ResponseLabels(header http.Header) map[string]string {
+	if l.gcplog == nil {
+		return nil
+	}
+	labels := map[string]string{}
+	for _, name := range l.gcplog.options().ResponseLabelHeaders {
+		if value := header.Get(name); value != "" {
+			labels["response_header."+strings.ToLower(name)] = value
+		}
+	}
+	return nilIfEmpty(labels)
+}
+
+// Body returns the captured response body, or nil if it isn't captured.
+func (l *RequestLog) Body() *bytes.Buffer {
+	if l.body == nil {
+		return nil
+	}
+	return l.body.buffer()
+}
+
+// End logs the request, r being its latest version (handlers may have
+// replaced it to carry values in its context).
+func (l *RequestLog) End(r *http.Request, outcome RequestOutcome) {
+	g := l.gcplog
+	if g == nil {
+		return
+	}
+
+	logged := g.loggedRequest(r)
+	logger := g
+	path := logged.URL.Path
+	if outcome.Route != "" {
+		logger = g.withLabels(map[string]string{"path": path})
+		path = outcome.Route
+	}
+	if len(outcome.Labels) > 0 {
+		logger = logger.WithLabels(outcome.Labels)
+	}
+
+	log := outcome.Log
+	if log == "" {
+		log = logged.Method + " " + path
+		if logged.URL.RawQuery != "" {
+			log += "?" + logged.URL.RawQuery
+		}
+		if id := RequestID(r); id != "" {
+			log = "[" + id + "] " + log
+		}
+	}
+
+	responseMeta := ResponseMetadata{
+		Status:   outcome.Status,
+		Size:     outcome.Size,
+		Latency:  g.now().Sub(l.begin),
+		Sequence: l.sequence,
+	}
+
+	var err error
+	classify := false
+	if outcome.Status >= 400 {
+		if recorded := recordedErrorOf(r); recorded != nil {
+			err, classify = recorded, true
+		} else if outcome.Err != nil {
+			err, classify = outcome.Err, outcome.ClassifyErr
+		} else if l.body != nil {
+			err = errors.New(l.body.buffer().String())
+		} else {
+			err = errors.New(logged.Method + " " + logged.URL.Path)
+		}
+	}
+
+	declared := logging.Default
+	if classify && g.options().ClassifyError != nil {
+		declared = g.options().ClassifyError(err)
+	}
+	severity := g.severity(r, &responseMeta, declared)
+
+	// The client went away: only genuine server errors are still worth the
+	// remote write.
+	cancelled := severity < logging.Error && r.Context().Err() != nil
+	if cancelled || severity < logging.Warning && g.options().ErrorsOnly {
+		// The entries batched during the request are still flushed.
+		if isBatched(r) {
+			go g.FlushLogs()
+		}
+		return
+	}
+
+	if err != nil && l.requestBody != nil {
+		err = &requestBodyError{error: err, body: g.redactedBody(r, l.requestBody)}
+	}
+
+	final := *logger.requestLogger()
+	final.endsOperation = true
+	final.logResponse(severity, log, err, r, &responseMeta)
+}
+
+type recordedError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func withRecordedError(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), errorKey, &recordedError{}))
+}
+
+// SetError records err as the error of the request r handled by the
+// middlewares, which report it as is when the request fails, preserving
+// errors.Is and errors.As, instead of an error built from the response body.
+func SetError(r *http.Request, err error) {
+	if recorded, ok := r.Context().Value(errorKey).(*recordedError); ok {
+		recorded.mu.Lock()
+		recorded.err = err
+		recorded.mu.Unlock()
+	}
+}
+
+func recordedErrorOf(r *http.Request) error {
+	recorded, ok := r.Context().Value(errorKey).(*recordedError)
+	if !ok {
+		return nil
+	}
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	return recorded.err
+}
+
+// logTraceDecision logs how the trace of r is parsed, see DebugTrace.
+func (g *GcpLog) logTraceDecision(r *http.Request) {
+	trace, span, sampled := parseTrace(r, g.projectId)
+	g.log(map[string]interface{}{
+		"message":      "trace decision",
+		"trace_header": r.Header.Get(traceHeader),
+		"trace":        trace,
+		"span_id":      span,
+		"sampled":      sampled,
+	}, r, nil, logging.Debug)
+}
@@ -0,0 +1,51 @@
+package gcplog_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestEndFlushesBatchedEntriesWhenSkipped(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		errorsOnly bool
+		ctx        context.Context
+	}{
+		{"cancelled", false, cancelled},
+		{"errors only", true, context.Background()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gcplogtest.NewServer()
+			defer server.Close()
+			g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+				ClientOptions:        server.ClientOptions(),
+				BufferDelayThreshold: time.Minute,
+				ErrorsOnly:           tt.errorsOnly,
+			})
+			defer g.Close()
+
+			h := gcplog.Wrap(&g, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				g.LogR("inside", r)
+				// LogR is asynchronous: let the entry reach the batch.
+				time.Sleep(100 * time.Millisecond)
+			}))
+			r := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			entries := server.WaitForEntries(t, 1, 5*time.Second)
+			if entries[0].Payload != "inside" {
+				t.Errorf("payload = %v, want the entry logged by the handler", entries[0].Payload)
+			}
+		})
+	}
+}
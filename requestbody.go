@@ -0,0 +1,172 @@
+package gcplog
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DefaultRequestBodyLimit is the number of bytes of the request bodies
+// captured by default, see GcpLogOptions.CaptureRequestBody.
+const DefaultRequestBodyLimit = 4 * 1024
+
+// requestBodyCapture keeps the first bytes of a request body as the handler
+// reads it.
+type requestBodyCapture struct {
+	limit int
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *requestBodyCapture) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := c.limit - c.buf.Len(); len(b) > room {
+		c.buf.Write(b[:room])
+		c.truncated = true
+	} else {
+		c.buf.Write(b)
+	}
+	return len(b), nil
+}
+
+// requestBody tees the body read by the handler into its capture, so that
+// the handler still reads all of it.
+type requestBody struct {
+	io.Reader
+	io.Closer
+}
+
+// withRequestBodyCapture replaces the body of r with one captured up to
+// RequestBodyLimit, when GcpLogOptions.CaptureRequestBody is set.
+func (g *GcpLog) withRequestBodyCapture(r *http.Request) (*http.Request, *requestBodyCapture) {
+	if !g.options().CaptureRequestBody || r.Body == nil || r.Body == http.NoBody {
+		return r, nil
+	}
+	limit := g.options().RequestBodyLimit
+	if limit <= 0 {
+		limit = DefaultRequestBodyLimit
+	}
+	capture := &requestBodyCapture{limit: limit}
+	captured := r.WithContext(r.Context())
+	captured.Body = &requestBody{Reader: io.TeeReader(r.Body, capture), Closer: r.Body}
+	return captured, capture
+}
+
+// redactedBody returns the captured body of r, with the values of the
+// redacted query parameters redacted from form and JSON bodies.
+func (g *GcpLog) redactedBody(r *http.Request, c *requestBodyCapture) string {
+	c.mu.Lock()
+	raw := append([]byte(nil), c.buf.Bytes()...)
+	truncated := c.truncated
+	c.mu.Unlock()
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	decoded, decodedTruncated, err := decodeBody(encoding, raw, c.limit)
+	if err != nil {
+		return fmt.Sprintf("<%s-encoded %d bytes>", encoding, len(raw))
+	}
+	body := string(decoded)
+	truncated = truncated || decodedTruncated
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		body = g.redactQuery(body)
+	case "application/json":
+		var v interface{}
+		// A truncated body is not valid JSON and is kept as is.
+		if err := json.Unmarshal([]byte(body), &v); err == nil {
+			if b, err := json.Marshal(g.redactJSON(v)); err == nil {
+				body = string(b)
+			}
+		}
+	}
+	if truncated {
+		body += "…"
+	}
+	return body
+}
+
+// decodeBody decompresses the first bytes of a body sent with the content
+// encoding, up to limit bytes. The bytes are usually cut in the middle of the
+// stream, so what could be decompressed before the cut is returned.
+// Brotli, without a decoder in the standard library, is an error.
+func decodeBody(encoding string, b []byte, limit int) (decoded []byte, truncated bool, err error) {
+	var reader io.Reader
+	switch encoding {
+	case "", "identity":
+		return b, false, nil
+	case "gzip", "x-gzip":
+		if reader, err = gzip.NewReader(bytes.NewReader(b)); err != nil {
+			return nil, false, err
+		}
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but raw streams are common.
+		if reader, err = zlib.NewReader(bytes.NewReader(b)); err != nil {
+			reader = flate.NewReader(bytes.NewReader(b))
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	decoded, err = ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if len(decoded) > limit {
+		return decoded[:limit], true, nil
+	}
+	if err != nil {
+		if len(decoded) == 0 {
+			return nil, false, err
+		}
+		return decoded, true, nil
+	}
+	return decoded, false, nil
+}
+
+func (g *GcpLog) redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if g.isRedactedQueryParam(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = g.redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = g.redactJSON(value)
+		}
+	}
+	return v
+}
+
+// requestBodyError carries the request body of a failed request into the
+// payload of its entry. Its message is the one of the error, so that the
+// grouping of Error Reporting isn't split by the bodies.
+type requestBodyError struct {
+	error
+	body string
+}
+
+func (e *requestBodyError) Unwrap() error { return e.error }
+
+func (e *requestBodyError) Payload() map[string]interface{} {
+	payload, ok := errorPayload(e.error).(map[string]interface{})
+	if !ok {
+		payload = map[string]interface{}{"message": e.error.Error()}
+	}
+	payload["request_body"] = e.body
+	return payload
+}
@@ -0,0 +1,48 @@
+package gcplog
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// RequestID returns the id of the request: the one generated by the
+// middlewares when GcpLogOptions.GenerateRequestID is set, or else the
+// X-Request-ID header.
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey).(string); ok {
+		return id
+	}
+	return r.Header.Get("X-Request-ID")
+}
+
+// withRequestID generates an id for requests without a X-Request-ID header,
+// storing it in the request context and on the response header.
+func (g *GcpLog) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if !g.options().GenerateRequestID || r.Header.Get("X-Request-ID") != "" {
+		return r
+	}
+	id := g.newID()
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// newID returns a new id with IDGenerator, a UUID by default.
+func (g *GcpLog) newID() string {
+	if g.options().IDGenerator != nil {
+		return g.options().IDGenerator()
+	}
+	return newUUID()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("Could not generate request id: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,34 @@
+package gcplog
+
+import (
+	"errors"
+
+	"cloud.google.com/go/logging"
+)
+
+// Severity is the severity of an entry, re-exported so callers don't need to
+// import cloud.google.com/go/logging.
+type Severity = logging.Severity
+
+const (
+	Default   = logging.Default
+	Debug     = logging.Debug
+	Info      = logging.Info
+	Notice    = logging.Notice
+	Warning   = logging.Warning
+	Error     = logging.Error
+	Critical  = logging.Critical
+	Alert     = logging.Alert
+	Emergency = logging.Emergency
+)
+
+// ErrorSeverity is a ClassifyError honoring the severity declared by the
+// errors of the chain of err with a Severity() Severity method, Default if
+// none does.
+func ErrorSeverity(err error) Severity {
+	var classified interface{ Severity() Severity }
+	if errors.As(err, &classified) {
+		return classified.Severity()
+	}
+	return Default
+}
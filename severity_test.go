@@ -0,0 +1,70 @@
+package gcplog_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+type severityError struct{ severity gcplog.Severity }
+
+func (e severityError) Error() string             { return "declared" }
+func (e severityError) Severity() gcplog.Severity { return e.severity }
+
+func TestRequestSeverityWithErrorSeverity(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   gcplog.Severity
+	}{
+		{"undeclared 4xx", http.StatusNotFound, errors.New("not found"), gcplog.Warning},
+		{"undeclared 5xx", http.StatusInternalServerError, errors.New("failed"), gcplog.Error},
+		{"declared", http.StatusInternalServerError, severityError{gcplog.Critical}, gcplog.Critical},
+		{"declared below status", http.StatusBadRequest, severityError{gcplog.Info}, gcplog.Info},
+		{"declared non error status", http.StatusConflict, severityError{gcplog.Critical}, gcplog.Warning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gcplogtest.NewServer()
+			defer server.Close()
+			options := server.FlushEvery(1)
+			options.ClassifyError = gcplog.ErrorSeverity
+			options.NonErrorStatuses = []int{http.StatusConflict}
+			g := gcplog.NewGcpLog("project", "service", options)
+			defer g.Close()
+
+			h := gcplog.Wrap(&g, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gcplog.SetError(r, tt.err)
+				w.WriteHeader(tt.status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			entries := server.WaitForEntries(t, 1, 5*time.Second)
+			if entries[0].Severity != tt.want {
+				t.Errorf("severity = %v, want %v", entries[0].Severity, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorSeverityDefaultsToError(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	options := server.FlushEvery(1)
+	options.ClassifyError = gcplog.ErrorSeverity
+	g := gcplog.NewGcpLog("project", "service", options)
+	defer g.Close()
+
+	g.Error(errors.New("undeclared"))
+
+	entries := server.WaitForEntries(t, 1, 5*time.Second)
+	if entries[0].Severity != gcplog.Error {
+		t.Errorf("severity = %v, want Error", entries[0].Severity)
+	}
+}
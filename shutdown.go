@@ -0,0 +1,62 @@
+package gcplog
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DrainOnSignal flushes and closes g on SIGTERM or SIGINT, waiting at most
+// timeout, then raises the signal again so that the process terminates as it
+// would have without the handler. Call it once at startup, e.g.
+// defer gcplog.DrainOnSignal(logger, 5*time.Second)().
+// The returned function removes the handler.
+func DrainOnSignal(g *GcpLog, timeout time.Duration) (cancel func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			g.drain(timeout)
+			signal.Stop(signals)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+}
+
+// drain flushes and closes g, giving up after timeout.
+func (g *GcpLog) drain(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := g.Flush(ctx); err != nil {
+		log.Printf("Could not drain logs: %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		g.Close()
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		log.Printf("Could not drain logs: close timed out after %v", timeout)
+	}
+}
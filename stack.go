@@ -0,0 +1,41 @@
+package gcplog
+
+import (
+	"bytes"
+	"regexp"
+)
+
+var goroutineHeaderRegex = regexp.MustCompile(`^goroutine \d+ \[[^\]]*\]:\n`)
+
+// normalizeStack makes a stack in the runtime.Stack format stable for the
+// grouping of Error Reporting: the goroutine header gets a fixed id, and the
+// frames of gcplog and runtime/debug.Stack on top are dropped, so that the
+// stack starts at the call site. The header is kept rather than stripped,
+// since Error Reporting needs it to recognize a Go stack.
+func normalizeStack(stack []byte) []byte {
+	header := goroutineHeaderRegex.Find(stack)
+	if header == nil {
+		return stack
+	}
+	frames := stack[len(header):]
+	for {
+		// A frame is a function line followed by a tab-indented file line.
+		end := bytes.IndexByte(frames, '\n')
+		if end < 0 || !isInternalFrame(frames[:end]) {
+			break
+		}
+		next := bytes.IndexByte(frames[end+1:], '\n')
+		if next < 0 {
+			break
+		}
+		frames = frames[end+1+next+1:]
+	}
+	return append([]byte("goroutine 1 [running]:\n"), frames...)
+}
+
+func isInternalFrame(function []byte) bool {
+	return bytes.HasPrefix(function, []byte("runtime/debug.Stack(")) ||
+		bytes.HasPrefix(function, []byte("github.com/ftognetto/gcplog.")) ||
+		bytes.HasPrefix(function, []byte("github.com/ftognetto/gcplog/otel.")) ||
+		bytes.HasPrefix(function, []byte("github.com/ftognetto/gcplog/gin."))
+}
@@ -0,0 +1,36 @@
+package gcplog_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestErrorStackStartsAtCallSite(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{ClientOptions: server.ClientOptions()})
+	defer g.Close()
+
+	g.Error(errors.New("boom"))
+
+	reports := server.WaitForErrors(t, 1, 5*time.Second)
+	lines := strings.Split(reports[0].Message, "\n")
+	if len(lines) < 3 {
+		t.Fatalf("report %q has no stack", reports[0].Message)
+	}
+	if lines[1] != "goroutine 1 [running]:" {
+		t.Errorf("stack header = %q, want the normalized one", lines[1])
+	}
+	if want := "github.com/ftognetto/gcplog_test.TestErrorStackStartsAtCallSite("; !strings.HasPrefix(lines[2], want) {
+		t.Errorf("first frame = %q, want the call site %s...)", lines[2], want)
+	}
+}
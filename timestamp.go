@@ -0,0 +1,33 @@
+package gcplog
+
+import (
+	"context"
+	"time"
+)
+
+// WithTimestamp returns a copy of ctx with which the ctx-aware methods
+// timestamp their entries at t instead of the time they are logged, e.g. the
+// time of the event being processed.
+func WithTimestamp(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timestampKey, t)
+}
+
+// Timestamped returns a logger timestamping its entries at t instead of the
+// time they are logged. Entries out of order are fine: Cloud Logging sorts
+// them by timestamp.
+func (g *GcpLog) Timestamped(t time.Time) *GcpLog {
+	if g == nil {
+		return nil
+	}
+	timestamped := *g
+	timestamped.timestamp = t
+	return &timestamped
+}
+
+// PubSubMessage returns a logger for the processing of a Pub/Sub message,
+// timestamping its entries at the publish time of the message, to
+// reconstruct the order of the events, and labelling them
+// "pubsub_message_id", e.g. g.PubSubMessage(msg.ID, msg.PublishTime).
+func (g *GcpLog) PubSubMessage(id string, publishTime time.Time) *GcpLog {
+	return g.Timestamped(publishTime).withLabels(map[string]string{"pubsub_message_id": id})
+}
@@ -0,0 +1,50 @@
+package gcplog
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func BenchmarkParseTrace(b *testing.B) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(traceHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parseTrace(r, "project")
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	const trace = "105445aa7843bc8bf206b12000100000"
+	tests := []struct {
+		name        string
+		header      string
+		wantTrace   string
+		wantSpan    string
+		wantSampled bool
+	}{
+		{"empty", "", "", "", false},
+		{"full", trace + "/1;o=1", "projects/project/traces/" + trace, "1", true},
+		{"not sampled", trace + "/1;o=0", "projects/project/traces/" + trace, "1", false},
+		{"trace only", trace, "projects/project/traces/" + trace, "", false},
+		{"no sampling", trace + "/1", "projects/project/traces/" + trace, "1", false},
+		{"zero span", trace + "/0;o=1", "projects/project/traces/" + trace, "", true},
+		{"no trace", "/1;o=1", "", "1", true},
+		{"not hex", "not-a-trace", "", "", false},
+		{"garbage", ";;//", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(traceHeader, tt.header)
+			}
+			trace, span, sampled := parseTrace(r, "project")
+			if trace != tt.wantTrace || span != tt.wantSpan || sampled != tt.wantSampled {
+				t.Errorf("parseTrace(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.header, trace, span, sampled, tt.wantTrace, tt.wantSpan, tt.wantSampled)
+			}
+		})
+	}
+}
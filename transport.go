@@ -0,0 +1,69 @@
+package gcplog
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/logging"
+)
+
+const traceHeader = "X-Cloud-Trace-Context"
+
+type transport struct {
+	base   http.RoundTripper
+	gcplog *GcpLog
+}
+
+// Transport wraps base (http.DefaultTransport if nil) so that every outbound
+// call is logged with its method, host, status and latency. The trace header
+// of the inbound request, when the outbound request carries its context, is
+// propagated downstream so both calls are correlated in Cloud Trace.
+func Transport(base http.RoundTripper, g *GcpLog) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base, gcplog: g}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.gcplog == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	if header, ok := req.Context().Value(traceHeaderKey).(string); ok && req.Header.Get(traceHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(traceHeader, header)
+	}
+
+	begin := t.gcplog.now()
+	resp, err := t.base.RoundTrip(req)
+	responseMeta := ResponseMetadata{
+		Latency: t.gcplog.now().Sub(begin),
+	}
+	log := "-> " + req.Method + " " + req.URL.Host + req.URL.Path
+	// The entry keeps the trace and batch of the inbound request, but
+	// neither joins its operation nor counts as its report.
+	logged := req.WithContext(outboundContext{req.Context()})
+
+	if err != nil {
+		t.gcplog.logResponse(logging.Error, log, err, logged, &responseMeta)
+		return resp, err
+	}
+
+	responseMeta.Status = resp.StatusCode
+	if resp.ContentLength > 0 {
+		responseMeta.Size = int(resp.ContentLength)
+	}
+	t.gcplog.logResponse(defaultSeverity(req, resp.StatusCode), log, nil, logged, &responseMeta)
+	return resp, nil
+}
+
+// withTraceHeader stores the trace header of an inbound request in its
+// context, for Transport to propagate it.
+func withTraceHeader(r *http.Request) *http.Request {
+	header := r.Header.Get(traceHeader)
+	if header == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), traceHeaderKey, header))
+}
@@ -0,0 +1,74 @@
+package gcplog_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestTransportInsideMiddleware(t *testing.T) {
+	os.Setenv("GO_ENV", "production")
+	defer os.Unsetenv("GO_ENV")
+
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", gcplog.GcpLogOptions{
+		ClientOptions:            server.ClientOptions(),
+		BufferDelayThreshold:     time.Minute,
+		SuppressDuplicateReports: true,
+	})
+	defer g.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+	client := &http.Client{Transport: gcplog.Transport(nil, &g)}
+
+	var duringRequest []gcplogtest.Entry
+	h := gcplog.Wrap(&g, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.LogR("inside", r)
+		// LogR is asynchronous: let the entry reach the batch first.
+		time.Sleep(50 * time.Millisecond)
+
+		outbound, _ := http.NewRequestWithContext(r.Context(), "GET", backend.URL, nil)
+		if _, err := client.Do(outbound); err == nil {
+			t.Error("outbound call to a closed server succeeded")
+		}
+		// The outbound entry is asynchronous too.
+		time.Sleep(50 * time.Millisecond)
+		duringRequest = server.Entries()
+
+		gcplog.SetError(r, errors.New("inbound failed"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	// The batch of the request, outbound entry included, is flushed when it
+	// ends rather than during the outbound call.
+	if len(duringRequest) != 0 {
+		t.Errorf("entries written during the request = %+v, want none", duringRequest)
+	}
+
+	entries := server.WaitForEntries(t, 3, 5*time.Second)
+	for _, e := range entries {
+		switch {
+		case e.Payload == "inside" && (e.Operation == nil || !e.Operation.First):
+			t.Errorf("entry of the handler has operation %v, want the first of the request", e.Operation)
+		case e.HTTPRequest.GetRequestUrl() == backend.URL && e.Operation != nil:
+			t.Errorf("outbound entry has operation %v, want none", e.Operation)
+		}
+	}
+
+	// Both the outbound and the inbound errors are reported.
+	reports := server.WaitForErrors(t, 2, 5*time.Second)
+	if len(reports) != 2 {
+		t.Errorf("got %d error reports, want 2", len(reports))
+	}
+}
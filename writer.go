@@ -0,0 +1,66 @@
+package gcplog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// Writer returns a writer logging each line written to it as an entry at
+// severity, e.g. for log.SetOutput or libraries only accepting an io.Writer.
+// Partial lines are buffered until their newline is written, or the writer is
+// closed.
+func (g *GcpLog) Writer(severity Severity) io.WriteCloser {
+	return &lineWriter{gcplog: g, severity: severity}
+}
+
+type lineWriter struct {
+	gcplog   *GcpLog
+	severity Severity
+	mu       sync.Mutex
+	buf      []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	if w.gcplog == nil {
+		return len(b), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		// Timestamped now, so that the lines keep their order although they
+		// are logged asynchronously.
+		go w.gcplog.Timestamped(time.Now()).log(line, nil, nil, w.severity)
+	}
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	return len(b), nil
+}
+
+// Close logs the trailing partial line, if any, before returning. It doesn't
+// close the logger.
+func (w *lineWriter) Close() error {
+	if w.gcplog == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := string(bytes.TrimRight(w.buf, "\r"))
+	w.buf = nil
+	if line != "" {
+		w.gcplog.Timestamped(time.Now()).log(line, nil, nil, w.severity)
+	}
+	return nil
+}
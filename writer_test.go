@@ -0,0 +1,25 @@
+package gcplog_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ftognetto/gcplog"
+	"github.com/ftognetto/gcplog/gcplogtest"
+)
+
+func TestWriterCloseLogsPartialLine(t *testing.T) {
+	server := gcplogtest.NewServer()
+	defer server.Close()
+	g := gcplog.NewGcpLog("project", "service", server.FlushEvery(1))
+	defer g.Close()
+
+	w := g.Writer(gcplog.Info)
+	io.WriteString(w, "line\npartial")
+	w.Close()
+
+	server.WaitForEntries(t, 2, 5*time.Second)
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool { return e.Payload == "line" })
+	server.AssertEntry(t, func(e gcplogtest.Entry) bool { return e.Payload == "partial" })
+}